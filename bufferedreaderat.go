@@ -0,0 +1,148 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package readahead
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrTooLarge is returned by readers created with NewBufferedReaderAt
+// when the input is larger than the maximum size.
+var ErrTooLarge = errors.New("readahead: input larger than max size")
+
+// bufferedReaderAt reads all of the input into memory.
+type bufferedReaderAt struct {
+	rd  io.Reader
+	max int
+
+	mu     sync.Mutex
+	cond   *sync.Cond // Signalled when data or err has been updated, or on Close.
+	data   []byte     // Data read so far
+	err    error      // Error returned by the input, or ErrTooLarge
+	off    int64      // Position of Read
+	closed bool
+}
+
+// NewBufferedReaderAt returns a reader that reads all of rd into memory,
+// which allows it to be used as an io.ReaderAt, even when rd isn't.
+// This is intended for small inputs that must be accessed
+// through io.ReaderAt, like archives received as a request body.
+//
+// The input is read in the background, and ReadAt calls wait until the
+// requested data has been read. ReadAt can be called concurrently.
+// Read reads sequentially from the start of the input.
+//
+// If the input is larger than maxSize bytes,
+// reads beyond maxSize will return ErrTooLarge.
+// Close will not close the input, and will not interrupt
+// a read from the input that is blocked.
+func NewBufferedReaderAt(rd io.Reader, maxSize int) (ReadAtCloser, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("max size too small")
+	}
+	if rd == nil {
+		return nil, fmt.Errorf("nil input reader supplied")
+	}
+	b := &bufferedReaderAt{rd: rd, max: maxSize}
+	b.cond = sync.NewCond(&b.mu)
+	go b.run()
+	return b, nil
+}
+
+// run reads the input until EOF, an error or maxSize has been exceeded.
+func (b *bufferedReaderAt) run() {
+	buf := make([]byte, 32<<10)
+	for {
+		b.mu.Lock()
+		// Read at most one byte more than allowed.
+		rem := b.max - len(b.data) + 1
+		b.mu.Unlock()
+		if rem < len(buf) {
+			buf = buf[:rem]
+		}
+		n, err := b.rd.Read(buf)
+
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return
+		}
+		if len(b.data)+n > b.max {
+			n = b.max - len(b.data)
+			err = ErrTooLarge
+		}
+		b.data = append(b.data, buf[:n]...)
+		if err != nil {
+			b.err = err
+		}
+		b.cond.Broadcast()
+		b.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// wait until the data up to end is available, the input has returned
+// an error, or the reader has been closed.
+// b.mu must be held.
+func (b *bufferedReaderAt) wait(end int64) error {
+	for int64(len(b.data)) < end && b.err == nil && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// ReadAt reads len(p) bytes starting at offset off.
+// It waits until the data has been read from the input.
+func (b *bufferedReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("readahead: negative offset")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.wait(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+	if off < int64(len(b.data)) {
+		n = copy(p, b.data[off:])
+	}
+	if n < len(p) {
+		return n, b.err
+	}
+	return n, nil
+}
+
+// Read will return the next available data.
+func (b *bufferedReaderAt) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.wait(b.off + 1); err != nil {
+		return 0, err
+	}
+	if b.off < int64(len(b.data)) {
+		n = copy(p, b.data[b.off:])
+		b.off += int64(n)
+		return n, nil
+	}
+	return 0, b.err
+}
+
+// Close releases the data and stops reading from the input.
+func (b *bufferedReaderAt) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.data = nil
+	b.cond.Broadcast()
+	return nil
+}
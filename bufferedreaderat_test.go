@@ -0,0 +1,88 @@
+package readahead_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/klauspost/readahead"
+)
+
+func TestBufferedReaderAt(t *testing.T) {
+	input := make([]byte, 100000)
+	rng := rand.New(rand.NewSource(0))
+	rng.Read(input)
+	ar, err := readahead.NewBufferedReaderAt(iotest.HalfReader(bytes.NewReader(input)), len(input))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for j := 0; j < 100; j++ {
+				off := rng.Int63n(int64(len(input)))
+				dst := make([]byte, rng.Intn(1000))
+				n, err := ar.ReadAt(dst, off)
+				want := input[off:]
+				if len(want) > len(dst) {
+					want = want[:len(dst)]
+				}
+				if len(want) < len(dst) && err != io.EOF {
+					t.Errorf("want EOF at end, got %v", err)
+					return
+				}
+				if len(want) == len(dst) && err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				if !bytes.Equal(dst[:n], want) {
+					t.Errorf("data mismatch at offset %d", off)
+					return
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+	if err := ar.Close(); err != nil {
+		t.Fatal("error when closing:", err)
+	}
+	if _, err := ar.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Fatal("expected error after Close, got nil")
+	}
+}
+
+func TestBufferedReaderAtTooLarge(t *testing.T) {
+	input := make([]byte, 1000)
+	ar, err := readahead.NewBufferedReaderAt(bytes.NewReader(input), 500)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	if n, err := ar.ReadAt(make([]byte, 100), 400); n != 100 || err != nil {
+		t.Fatalf("want 100, <nil>, got %d, %v", n, err)
+	}
+	if n, err := ar.ReadAt(make([]byte, 100), 450); n != 50 || err != readahead.ErrTooLarge {
+		t.Fatalf("want 50, %v, got %d, %v", readahead.ErrTooLarge, n, err)
+	}
+	got, err := ioutil.ReadAll(ar)
+	if err != readahead.ErrTooLarge || len(got) != 500 {
+		t.Fatalf("want 500 bytes, %v, got %d, %v", readahead.ErrTooLarge, len(got), err)
+	}
+	if _, err := readahead.NewBufferedReaderAt(nil, 500); err == nil {
+		t.Fatal("expected error when creating, but got nil")
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package readahead
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Chunk is data sent to a reader created by NewChunkReader.
+// If Err is non-nil it is returned by the reader after Data,
+// and no more chunks are read.
+type Chunk struct {
+	Data []byte
+	Err  error
+}
+
+// NewChannelReader returns a reader that reads ahead from slices received on ch.
+// Closing ch ends the input, which returns io.EOF after all data has been read.
+// Slices are copied into the buffers, but must not be modified after they have been sent.
+//
+// Buffers are filled completely before being handed to the consumer,
+// so data from a producer that pauses may be held back,
+// unless WithCoalesce is used.
+// Close will not wait for the next slice to be sent.
+// Options can be supplied to change the behaviour of the reader.
+func NewChannelReader(ch <-chan []byte, buffers, size int, opts ...Option) (io.ReadCloser, error) {
+	if ch == nil {
+		return nil, fmt.Errorf("nil channel supplied")
+	}
+	return newChanReader(buffers, size, opts, func(done <-chan struct{}) ([]byte, error) {
+		select {
+		case b, ok := <-ch:
+			if !ok {
+				return nil, io.EOF
+			}
+			return b, nil
+		case <-done:
+			return nil, errChanClosed
+		}
+	})
+}
+
+// NewChunkReader returns a reader like NewChannelReader,
+// where the producer can end the input with an error.
+// Closing ch ends the input like a Chunk with io.EOF.
+func NewChunkReader(ch <-chan Chunk, buffers, size int, opts ...Option) (io.ReadCloser, error) {
+	if ch == nil {
+		return nil, fmt.Errorf("nil channel supplied")
+	}
+	return newChanReader(buffers, size, opts, func(done <-chan struct{}) ([]byte, error) {
+		select {
+		case c, ok := <-ch:
+			if !ok {
+				return nil, io.EOF
+			}
+			return c.Data, c.Err
+		case <-done:
+			return nil, errChanClosed
+		}
+	})
+}
+
+// errChanClosed is returned by chanReader when the reader is closed.
+var errChanClosed = errors.New("readahead: reader closed")
+
+// newChanReader returns a reader reading from a chanReader using recv.
+func newChanReader(buffers, size int, opts []Option, recv func(done <-chan struct{}) ([]byte, error)) (io.ReadCloser, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("buffer size too small")
+	}
+	if buffers <= 0 {
+		return nil, fmt.Errorf("number of buffers too small")
+	}
+	a := &reader{}
+	if err := a.setOptions(opts); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	a.unblock = func() {
+		once.Do(func() { close(done) })
+	}
+	a.init(&chanReader{recv: func() ([]byte, error) {
+		return recv(done)
+	}}, buffers, size)
+	return a, nil
+}
+
+// chanReader reads slices returned by recv.
+type chanReader struct {
+	recv func() ([]byte, error) // Returns the next slice, and an error if no more follow
+	rem  []byte                 // Remaining data of the last slice
+	err  error                  // Returned when rem is empty
+}
+
+func (c *chanReader) Read(p []byte) (int, error) {
+	for len(c.rem) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.rem, c.err = c.recv()
+	}
+	n := copy(p, c.rem)
+	c.rem = c.rem[n:]
+	return n, nil
+}
@@ -0,0 +1,66 @@
+package readahead_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/readahead"
+)
+
+func TestChannelReader(t *testing.T) {
+	ch := make(chan []byte)
+	ar, err := readahead.NewChannelReader(ch, 4, 10)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	var want []byte
+	go func() {
+		for i := 0; i < 100; i++ {
+			b := bytes.Repeat([]byte{byte(i)}, i%15)
+			ch <- b
+		}
+		close(ch)
+	}()
+	for i := 0; i < 100; i++ {
+		want = append(want, bytes.Repeat([]byte{byte(i)}, i%15)...)
+	}
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("output mismatch")
+	}
+	ar.Close()
+
+	// Close doesn't wait for the producer.
+	ar, err = readahead.NewChannelReader(make(chan []byte), 4, 10)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if err := ar.Close(); err != nil {
+		t.Fatal("error when closing:", err)
+	}
+}
+
+func TestChunkReader(t *testing.T) {
+	theErr := errors.New("producer failed")
+	ch := make(chan readahead.Chunk, 3)
+	ch <- readahead.Chunk{Data: []byte("Test")}
+	ch <- readahead.Chunk{Data: []byte("buffer"), Err: theErr}
+	ch <- readahead.Chunk{Data: []byte("never read")}
+	ar, err := readahead.NewChunkReader(ch, 4, 3)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	got, err := ioutil.ReadAll(ar)
+	if !errors.Is(err, theErr) {
+		t.Fatal("want", theErr, "got", err)
+	}
+	if string(got) != "Testbuffer" {
+		t.Fatalf("want %q, got %q", "Testbuffer", got)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package readahead
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+// decompressor is a registered decompressor.
+type decompressor struct {
+	magic []byte
+	fn    func(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	decompressorsMu sync.RWMutex
+	decompressors   = []decompressor{
+		{
+			magic: []byte{0x1f, 0x8b},
+			fn: func(r io.Reader) (io.ReadCloser, error) {
+				return gzip.NewReader(r)
+			},
+		},
+	}
+)
+
+// maxMagic is the longest magic that can be registered.
+const maxMagic = 64
+
+// RegisterDecompressor registers a decompressor used by NewAutoDecompressReader
+// for input starting with magic.
+// Only gzip is registered by default, so other formats can be added
+// without this package depending on them.
+// For example zstd can be added using github.com/klauspost/compress/zstd:
+//
+//	readahead.RegisterDecompressor([]byte{0x28, 0xb5, 0x2f, 0xfd}, func(r io.Reader) (io.ReadCloser, error) {
+//		dec, err := zstd.NewReader(r)
+//		if err != nil {
+//			return nil, err
+//		}
+//		return dec.IOReadCloser(), nil
+//	})
+//
+// A decompressor registered with the same magic as an existing one replaces it.
+func RegisterDecompressor(magic []byte, fn func(r io.Reader) (io.ReadCloser, error)) error {
+	if len(magic) == 0 || len(magic) > maxMagic {
+		return errors.New("invalid magic length")
+	}
+	if fn == nil {
+		return errors.New("nil decompressor supplied")
+	}
+	decompressorsMu.Lock()
+	defer decompressorsMu.Unlock()
+	magic = append([]byte(nil), magic...)
+	for i, d := range decompressors {
+		if bytes.Equal(d.magic, magic) {
+			decompressors[i].fn = fn
+			return nil
+		}
+	}
+	decompressors = append(decompressors, decompressor{magic: magic, fn: fn})
+	return nil
+}
+
+// NewAutoDecompressReader returns a reader that will detect compressed input
+// and asynchronously read ahead from the decompressed stream.
+// The compression is detected from the first bytes of the input,
+// see RegisterDecompressor for supported formats.
+// If no known format is detected, the input is read as is.
+//
+// The returned reader uses the default number of buffers and buffer size,
+// see SetDefaults.
+// Options can be supplied to change the behaviour of the reader.
+// Close will release the decompressor, but not close the input.
+func NewAutoDecompressReader(rd io.Reader, opts ...Option) (io.ReadCloser, error) {
+	if rd == nil {
+		return nil, errors.New("nil input reader supplied")
+	}
+	decompressorsMu.RLock()
+	decs := append([]decompressor(nil), decompressors...)
+	decompressorsMu.RUnlock()
+
+	// Only wait for as many bytes as the longest magic,
+	// so short inputs can be detected before they are complete.
+	longest := 0
+	for _, d := range decs {
+		if len(d.magic) > longest {
+			longest = len(d.magic)
+		}
+	}
+	br := bufio.NewReaderSize(rd, longest)
+	// A short input doesn't match magics longer than it.
+	// Other errors will be returned when reading.
+	head, _ := br.Peek(longest)
+
+	var fn func(r io.Reader) (io.ReadCloser, error)
+	for _, d := range decs {
+		if bytes.HasPrefix(head, d.magic) {
+			fn = d.fn
+			break
+		}
+	}
+
+	buffers, size := defaults()
+	if fn == nil {
+		return NewReaderSize(br, buffers, size, opts...)
+	}
+	dec, err := fn(br)
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]Option{WithCloser(dec)}, opts...)
+	return NewReaderSize(dec, buffers, size, opts...)
+}
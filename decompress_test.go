@@ -0,0 +1,110 @@
+package readahead_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/readahead"
+)
+
+func TestAutoDecompressReader(t *testing.T) {
+	input := strings.Repeat("Testbuffer", 1000)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(input))
+	w.Close()
+
+	for name, in := range map[string][]byte{"gzip": gz.Bytes(), "raw": []byte(input)} {
+		ar, err := readahead.NewAutoDecompressReader(bytes.NewBuffer(in))
+		if err != nil {
+			t.Fatal(name, "error when creating:", err)
+		}
+		b, err := ioutil.ReadAll(ar)
+		if err != nil {
+			t.Fatal(name, "error when reading:", err)
+		}
+		if string(b) != input {
+			t.Fatal(name, "output mismatch")
+		}
+		if err := ar.Close(); err != nil {
+			t.Fatal(name, "error when closing:", err)
+		}
+	}
+
+	// Short input
+	ar, err := readahead.NewAutoDecompressReader(strings.NewReader("a"))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	b, err := ioutil.ReadAll(ar)
+	if err != nil || string(b) != "a" {
+		t.Fatal("unexpected result:", string(b), err)
+	}
+	ar.Close()
+
+	// Custom decompressor
+	magic := []byte("UPPER")
+	err = readahead.RegisterDecompressor(magic, func(r io.Reader) (io.ReadCloser, error) {
+		if _, err := io.ReadFull(r, make([]byte, len(magic))); err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(r)
+		return ioutil.NopCloser(strings.NewReader(strings.ToUpper(string(b)))), err
+	})
+	if err != nil {
+		t.Fatal("error when registering:", err)
+	}
+	ar, err = readahead.NewAutoDecompressReader(strings.NewReader("UPPERtestbuffer"))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	b, err = ioutil.ReadAll(ar)
+	if err != nil || string(b) != "TESTBUFFER" {
+		t.Fatal("unexpected result:", string(b), err)
+	}
+	ar.Close()
+
+	// Input shorter than the magic doesn't match.
+	ar, err = readahead.NewAutoDecompressReader(strings.NewReader("UPP"))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	b, err = ioutil.ReadAll(ar)
+	if err != nil || string(b) != "UPP" {
+		t.Fatal("unexpected result:", string(b), err)
+	}
+	ar.Close()
+
+	// Only the longest magic is waited for.
+	pr, pw := io.Pipe()
+	created := make(chan io.ReadCloser, 1)
+	go func() {
+		ar, err := readahead.NewAutoDecompressReader(pr)
+		if err != nil {
+			t.Error("error when creating:", err)
+		}
+		created <- ar
+	}()
+	pw.Write([]byte("stream"))
+	select {
+	case ar = <-created:
+	case <-time.After(5 * time.Second):
+		t.Fatal("NewAutoDecompressReader waited for more input")
+	}
+	pw.Write([]byte("ing"))
+	pw.Close()
+	b, err = ioutil.ReadAll(ar)
+	if err != nil || string(b) != "streaming" {
+		t.Fatal("unexpected result:", string(b), err)
+	}
+	ar.Close()
+
+	if err := readahead.RegisterDecompressor(nil, nil); err == nil {
+		t.Fatal("expected error when registering, but got nil")
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package readahead
+
+import (
+	"fmt"
+	"io"
+)
+
+// NewReaderDeterministic returns a reader with a custom number of buffers and size,
+// where reads from the input follow schedule.
+// Each read from the input returns at most the number of bytes
+// given by the next entry of schedule. The schedule is repeated when exhausted.
+//
+// Buffers are always filled completely before being handed to the consumer,
+// so the data returned by each read only depends on the input,
+// the schedule and the size of the reads, and not on timing.
+// This makes it suitable for reproducing fuzzing failures of code using the reader.
+func NewReaderDeterministic(rd io.Reader, schedule []int, buffers, size int) (io.ReadCloser, error) {
+	if rd == nil {
+		return nil, fmt.Errorf("nil input reader supplied")
+	}
+	if len(schedule) == 0 {
+		return nil, fmt.Errorf("empty read schedule")
+	}
+	for _, n := range schedule {
+		if n <= 0 {
+			return nil, fmt.Errorf("read schedule entries must be positive")
+		}
+	}
+	sr := &scheduleReader{rd: rd, schedule: append([]int(nil), schedule...)}
+	return NewReaderSize(sr, buffers, size)
+}
+
+// scheduleReader limits the size of each read to the next schedule entry.
+type scheduleReader struct {
+	rd       io.Reader
+	schedule []int
+	next     int
+}
+
+func (s *scheduleReader) Read(p []byte) (int, error) {
+	if n := s.schedule[s.next]; len(p) > n {
+		p = p[:n]
+	}
+	s.next = (s.next + 1) % len(s.schedule)
+	return s.rd.Read(p)
+}
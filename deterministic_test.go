@@ -0,0 +1,73 @@
+package readahead_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/klauspost/readahead"
+)
+
+func TestNewReaderDeterministic(t *testing.T) {
+	input := make([]byte, 10000)
+	for i := range input {
+		input[i] = byte(i * 7 / 3)
+	}
+	schedule := []int{1, 17, 300, 5}
+	readSizes := []int{10, 1000, 3, 129}
+
+	// Record the size of each read.
+	run := func() ([]int, []byte) {
+		var calls []int
+		src := bytes.NewReader(input)
+		rd := dummyReader{readFN: func(dst []byte) (int, error) {
+			calls = append(calls, len(dst))
+			return src.Read(dst)
+		}}
+		ar, err := readahead.NewReaderDeterministic(rd, schedule, 3, 250)
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		defer ar.Close()
+		var got []byte
+		var sizes []int
+		for i := 0; ; i++ {
+			p := make([]byte, readSizes[i%len(readSizes)])
+			n, err := ar.Read(p)
+			got = append(got, p[:n]...)
+			sizes = append(sizes, n)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal("error when reading:", err)
+			}
+		}
+		for i, n := range calls {
+			if n > schedule[i%len(schedule)] {
+				t.Fatalf("input read %d was %d bytes, want at most %d", i, n, schedule[i%len(schedule)])
+			}
+		}
+		return sizes, got
+	}
+	sizes1, got := run()
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+	sizes2, _ := run()
+	if len(sizes1) != len(sizes2) {
+		t.Fatalf("read count mismatch: %d != %d", len(sizes1), len(sizes2))
+	}
+	for i := range sizes1 {
+		if sizes1[i] != sizes2[i] {
+			t.Fatalf("read %d: size mismatch %d != %d", i, sizes1[i], sizes2[i])
+		}
+	}
+
+	for _, schedule := range [][]int{nil, {1, 0}, {-1}} {
+		_, err := readahead.NewReaderDeterministic(bytes.NewReader(input), schedule, 3, 250)
+		if err == nil {
+			t.Fatalf("schedule %v: expected error when creating, but got nil", schedule)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package readahead
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// NewSeekableFromFactory returns a reader that reads ahead from the input returned by open,
+// and supports seeking by opening the input again.
+//
+// Seeking closes the current input and calls open to get a new one.
+// If the new input supports io.Seeker it is seeked to the new position,
+// otherwise data is read and discarded until the new position.
+// The position is tracked by the reader, so seeking to the current position,
+// like asking for the position, doesn't open the input again.
+// Seeking relative to the end is only supported if the input supports io.Seeker.
+// Errors from open are returned by Seek, or by NewSeekableFromFactory on the first call.
+// Close closes the current input.
+func NewSeekableFromFactory(open func() (io.ReadCloser, error), buffers, size int, opts ...Option) (ReadSeekCloser, error) {
+	if open == nil {
+		return nil, fmt.Errorf("nil open function supplied")
+	}
+	rc, err := open()
+	if err != nil {
+		return nil, err
+	}
+	src := &factorySource{open: open, rc: rc}
+	res, err := NewReadSeekCloserSize(src, buffers, size, opts...)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+// factorySource is an input that seeks by opening a new input.
+type factorySource struct {
+	open func() (io.ReadCloser, error)
+	rc   io.ReadCloser // Current input, nil if opening failed
+	pos  int64         // Position of rc
+}
+
+func (f *factorySource) Read(p []byte) (int, error) {
+	if f.rc == nil {
+		return 0, errors.New("readahead: no input after failed seek")
+	}
+	n, err := f.rc.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *factorySource) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		s, ok := f.rc.(io.Seeker)
+		if !ok {
+			return 0, errors.New("readahead: input does not support seeking from the end")
+		}
+		end, err := s.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		// Restore the position.
+		if _, err := s.Seek(f.pos, io.SeekStart); err != nil {
+			return 0, err
+		}
+		offset += end
+	default:
+		return 0, errors.New("readahead: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("readahead: negative position")
+	}
+	if offset == f.pos && f.rc != nil {
+		return offset, nil
+	}
+	if f.rc != nil {
+		f.rc.Close()
+		f.rc = nil
+	}
+	rc, err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	f.rc, f.pos = rc, 0
+	if s, ok := rc.(io.Seeker); ok {
+		pos, err := s.Seek(offset, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+		f.pos = pos
+		return pos, nil
+	}
+	n, err := io.CopyN(ioutil.Discard, rc, offset)
+	f.pos = n
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	// Positions after the end are allowed, like for files.
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *factorySource) Close() error {
+	if f.rc == nil {
+		return nil
+	}
+	err := f.rc.Close()
+	f.rc = nil
+	return err
+}
@@ -0,0 +1,65 @@
+package readahead_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/readahead"
+)
+
+func TestSeekableFromFactory(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	opens := 0
+	var openErr error
+	open := func() (io.ReadCloser, error) {
+		if openErr != nil {
+			return nil, openErr
+		}
+		opens++
+		// Hide io.Seeker.
+		return ioutil.NopCloser(bytes.NewBuffer(input)), nil
+	}
+	ar, err := readahead.NewSeekableFromFactory(open, 4, 64)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	got := make([]byte, 10)
+	if _, err := io.ReadFull(ar, got); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	// Position queries don't open the input.
+	if pos, err := ar.Seek(0, io.SeekCurrent); pos != 10 || err != nil {
+		t.Fatalf("want (10, nil), got (%d, %v)", pos, err)
+	}
+	for _, pos := range []int64{555, 5, 990} {
+		if got, err := ar.Seek(pos, io.SeekStart); got != pos || err != nil {
+			t.Fatalf("want (%d, nil), got (%d, %v)", pos, got, err)
+		}
+		if _, err := io.ReadFull(ar, got); err != nil {
+			t.Fatal("error when reading:", err)
+		}
+		if !bytes.Equal(got, input[pos:pos+10]) {
+			t.Fatalf("data at %d mismatch", pos)
+		}
+	}
+	if opens != 4 {
+		t.Fatalf("want 4 opens, got %d", opens)
+	}
+	if _, err := ar.Seek(-1, io.SeekEnd); err == nil {
+		t.Fatal("expected error seeking from end")
+	}
+
+	// Errors from open are returned.
+	openErr = errors.New("open failed")
+	if _, err := ar.Seek(0, io.SeekStart); err != openErr {
+		t.Fatal("want", openErr, "got", err)
+	}
+	if _, err := readahead.NewSeekableFromFactory(open, 4, 64); err != openErr {
+		t.Fatal("want", openErr, "got", err)
+	}
+}
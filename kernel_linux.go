@@ -0,0 +1,46 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+//go:build linux && (amd64 || arm64 || ppc64 || ppc64le || riscv64 || s390x)
+// +build linux
+// +build amd64 arm64 ppc64 ppc64le riscv64 s390x
+
+package readahead
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	fadvSequential = 2 // POSIX_FADV_SEQUENTIAL
+	fadvWillNeed   = 3 // POSIX_FADV_WILLNEED
+)
+
+// kernelAdvisor returns a function that asks the kernel to read
+// length bytes ahead of the current position of in.
+// nil is returned if in is not a file.
+func kernelAdvisor(in io.Reader) func(length int64) {
+	f, ok := in.(*os.File)
+	if !ok {
+		return nil
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	fadvise := func(off, length int64, advice int) {
+		rc.Control(func(fd uintptr) {
+			syscall.Syscall6(syscall.SYS_FADVISE64, fd, uintptr(off), uintptr(length), uintptr(advice), 0, 0)
+		})
+	}
+	// Increase the kernel read-ahead window.
+	fadvise(0, 0, fadvSequential)
+	return func(length int64) {
+		pos, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return
+		}
+		fadvise(pos, length, fadvWillNeed)
+	}
+}
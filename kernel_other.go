@@ -0,0 +1,13 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+//go:build !linux || !(amd64 || arm64 || ppc64 || ppc64le || riscv64 || s390x)
+// +build !linux !amd64,!arm64,!ppc64,!ppc64le,!riscv64,!s390x
+
+package readahead
+
+import "io"
+
+// kernelAdvisor is not supported on this platform.
+func kernelAdvisor(in io.Reader) func(length int64) {
+	return nil
+}
@@ -0,0 +1,612 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package readahead
+
+import (
+	"errors"
+	"hash"
+	"io"
+	"time"
+)
+
+// Option can be supplied to the constructors accepting options
+// to change the behaviour of the returned reader.
+type Option func(*reader) error
+
+// setOptions applies the supplied options.
+func (a *reader) setOptions(opts []Option) error {
+	for _, opt := range opts {
+		if err := opt(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithFailFast will make Read return an error from the input
+// as soon as the async reader has seen it.
+// WriteTo will stop writing and return the error before the next write.
+// Any data read before the error, which hasn't been returned yet,
+// will be discarded.
+// By default all data read before an error is returned before the error.
+func WithFailFast() Option {
+	return func(a *reader) error {
+		a.failFast = true
+		return nil
+	}
+}
+
+// WithLazyBuffers will only allocate a single buffer up front.
+// The remaining buffers are allocated when the first buffer has been filled
+// without reaching the end of the input.
+// This avoids allocating all buffers for small inputs.
+// It has no effect when buffers are supplied by the caller.
+func WithLazyBuffers() Option {
+	return func(a *reader) error {
+		a.lazy = true
+		return nil
+	}
+}
+
+// WithCoalesce limits how long data can be held back while a buffer is filled.
+// By default each buffer is filled completely before it is handed to the consumer,
+// which will combine many small reads from the input into a single buffer,
+// but may delay data from slow inputs.
+// With this option a buffer is handed over when it is full,
+// or when maxDelay has elapsed since the first data was read into it.
+// Since reads from the input cannot be interrupted the delay is checked
+// after each read from the input.
+func WithCoalesce(maxDelay time.Duration) Option {
+	return func(a *reader) error {
+		if maxDelay <= 0 {
+			return errors.New("coalesce delay must be positive")
+		}
+		a.cfg.maxDelay = maxDelay
+		return nil
+	}
+}
+
+// WithImmediateForward will hand a buffer to the consumer as soon as
+// a read from the input has returned data, instead of filling it completely.
+// This gives the lowest latency from the input to the consumer,
+// but each buffer may only hold the data of a single read from the input,
+// so more buffers may be needed to read as far ahead.
+// This takes precedence over WithCoalesce.
+func WithImmediateForward() Option {
+	return func(a *reader) error {
+		a.cfg.forward = true
+		return nil
+	}
+}
+
+// WithCloser will make Close call c.Close once the async reader has been stopped.
+// This allows a closer to be attached to any input.
+// If the input is also an io.ReadCloser supplied to a ReadCloser constructor,
+// c will be called instead of the Close method of the input.
+func WithCloser(c io.Closer) Option {
+	return func(a *reader) error {
+		if c == nil {
+			return errors.New("nil closer supplied")
+		}
+		a.closer = c
+		return nil
+	}
+}
+
+// WithRefreshSize will cache the size of seekable inputs when seeking
+// relative to the end, so the input doesn't need to find the end every time.
+// The size is probed again when it is older than d.
+// If d is 0 the size is only probed once, which is suitable for inputs that don't change size.
+// By default every seek relative to the end is forwarded to the input.
+func WithRefreshSize(d time.Duration) Option {
+	return func(a *reader) error {
+		if d < 0 {
+			return errors.New("negative size refresh interval")
+		}
+		a.sizeCache = true
+		a.sizeRefresh = d
+		return nil
+	}
+}
+
+// WithRecordSize will make Read only return whole records of n bytes.
+// Read will return as many whole records as fit in the supplied slice,
+// and return io.ErrShortBuffer if the slice cannot hold a single record.
+// Records that span several buffers are combined.
+// If the input ends with a partial record, it is returned with the error from the input.
+// This only affects Read.
+func WithRecordSize(n int) Option {
+	return func(a *reader) error {
+		if n <= 0 {
+			return errors.New("record size must be positive")
+		}
+		if a.noCoalesce {
+			return errors.New("record size cannot be used with WithNoCoalesce")
+		}
+		a.recordSize = n
+		return nil
+	}
+}
+
+// WithPanicPropagation will not recover panics from the input.
+// By default a panic while reading from the input is returned as an error.
+// With this option the panic will crash the program with the stack of the panic,
+// which can be useful when debugging inputs.
+// This also applies to panics in callbacks supplied to ForEachBuffer and WriteToFunc,
+// which close the reader before the panic continues.
+func WithPanicPropagation() Option {
+	return func(a *reader) error {
+		a.cfg.panics = true
+		return nil
+	}
+}
+
+// WithFillFunc will use fn to read data into buffers instead of
+// calling Read on the input.
+// fn must follow the io.Reader contract for Read.
+// This allows custom read strategies while keeping the read-ahead.
+// The input is still used for seeking and closing.
+func WithFillFunc(fn func(buf []byte) (int, error)) Option {
+	return func(a *reader) error {
+		if fn == nil {
+			return errors.New("nil fill function supplied")
+		}
+		a.fillFn = fn
+		return nil
+	}
+}
+
+// WithWriteRetry will make WriteTo retry writes that fail,
+// if retry returns true for the error returned by the writer.
+// The data that wasn't written is retried after a backoff,
+// which starts at 1ms and doubles for each retry up to 1 second.
+// If the context passed to WriteToContext is done while waiting,
+// the context error is returned.
+// If retry returns false the error is returned.
+func WithWriteRetry(retry func(err error) bool) Option {
+	return func(a *reader) error {
+		if retry == nil {
+			return errors.New("nil retry function supplied")
+		}
+		a.writeRetry = retry
+		return nil
+	}
+}
+
+// WithWriteReady will make WriteTo wait for a value on ready,
+// when a write to a non-blocking writer fails because it would block (EAGAIN).
+// The data that wasn't written is then retried.
+// If ready is closed while waiting, the error from the writer is returned.
+// Without this option such writes are retried after a backoff like WithWriteRetry.
+// Unlike WithWriteRetry this only applies to writes that would block,
+// and other errors are handled by the function set with WithWriteRetry, if any.
+func WithWriteReady(ready <-chan struct{}) Option {
+	return func(a *reader) error {
+		if ready == nil {
+			return errors.New("nil ready channel supplied")
+		}
+		a.writeReady = ready
+		return nil
+	}
+}
+
+// WithClosers adds closers that Close will call in order,
+// after the input has been closed.
+// All closers are called, even if some of them fail.
+// Close returns the first error encountered.
+// This is useful when the input consists of several resources.
+func WithClosers(closers ...io.Closer) Option {
+	return func(a *reader) error {
+		for _, c := range closers {
+			if c == nil {
+				return errors.New("nil closer supplied")
+			}
+		}
+		a.closers = append(a.closers, closers...)
+		return nil
+	}
+}
+
+// WithUnexpectedEOFRetries will retry reads from the input that return
+// io.ErrUnexpectedEOF up to n times, waiting backoff between each attempt.
+// Data returned along with the error is kept.
+// The count is reset when a read succeeds.
+// If the reader is closed or the total timeout expires while waiting,
+// no more retries are made.
+// The number of retries is available in Stats.
+func WithUnexpectedEOFRetries(n int, backoff time.Duration) Option {
+	return func(a *reader) error {
+		if n < 0 {
+			return errors.New("negative number of retries")
+		}
+		if backoff < 0 {
+			return errors.New("negative retry backoff")
+		}
+		a.cfg.eofRetries = n
+		a.cfg.eofBackoff = backoff
+		return nil
+	}
+}
+
+// WithLazyStart will delay reading from the input until data is first requested.
+// By default reading starts when the reader is created.
+// This avoids reading from inputs that may never be used.
+// The first buffer is then filled by the first read, and the async reader
+// is only started if the input has more data, so small inputs are read
+// without starting a goroutine.
+func WithLazyStart() Option {
+	return func(a *reader) error {
+		a.lazyStart = true
+		return nil
+	}
+}
+
+// WithName sets a name of the reader, which can be retrieved with Name.
+// This can be used to identify readers when debugging.
+// The name has no effect on the behaviour of the reader.
+func WithName(name string) Option {
+	return func(a *reader) error {
+		a.name = name
+		return nil
+	}
+}
+
+// WithWriteCoalesce will make WriteTo combine data from buffers that are ready
+// into a single write of up to max bytes.
+// This reduces the number of writes when buffers are only partially filled,
+// for example when using WithCoalesce.
+// Data is only copied when more than one buffer can be combined.
+func WithWriteCoalesce(max int) Option {
+	return func(a *reader) error {
+		if max <= 0 {
+			return errors.New("write coalesce size must be positive")
+		}
+		if a.noCoalesce {
+			return errors.New("write coalesce cannot be used with WithNoCoalesce")
+		}
+		a.writeCoalesce = max
+		return nil
+	}
+}
+
+// WithNoCoalesce guarantees that Read and WriteTo never combine data
+// from several buffers, so each Read or Write returns data from a single
+// fill of a buffer. This is useful when debugging how the input is chunked.
+// Read already behaves this way by default, but this option protects
+// against options that combine buffers, and returns an error if it is
+// used with WithRecordSize or WithWriteCoalesce.
+func WithNoCoalesce() Option {
+	return func(a *reader) error {
+		if a.recordSize > 0 {
+			return errors.New("WithNoCoalesce cannot be used with record size")
+		}
+		if a.writeCoalesce > 0 {
+			return errors.New("WithNoCoalesce cannot be used with write coalesce")
+		}
+		a.noCoalesce = true
+		return nil
+	}
+}
+
+// WithEOFOnEmptyRead will treat a read from the input that returns
+// no data and no error as the end of the input.
+// This is for inputs that signal the end of data by returning (0, nil)
+// instead of io.EOF, which would otherwise be read forever.
+// Inputs that return (0, nil) while waiting for more data
+// will be truncated, so only use this with inputs known to behave this way.
+func WithEOFOnEmptyRead() Option {
+	return func(a *reader) error {
+		a.cfg.emptyEOF = true
+		return nil
+	}
+}
+
+// WithMaxReadSize limits each read from the input to at most n bytes.
+// Buffers are still filled completely, using several reads if needed.
+// This allows large buffers to be used while keeping the size of reads from the input small.
+func WithMaxReadSize(n int) Option {
+	return func(a *reader) error {
+		if n <= 0 {
+			return errors.New("max read size must be positive")
+		}
+		a.cfg.maxRead = n
+		return nil
+	}
+}
+
+// WithStopDelimiter will make the reader stop reading from the input
+// when delim has been read.
+// Data up to and including the delimiter is returned, followed by io.EOF.
+// The input is never read past the delimiter,
+// so it can continue to be used after the delimiter.
+// To ensure that, reads from the input are limited to the part of
+// the delimiter that remains to be matched, so short delimiters will
+// result in small reads.
+func WithStopDelimiter(delim []byte) Option {
+	return func(a *reader) error {
+		if len(delim) == 0 {
+			return errors.New("empty delimiter")
+		}
+		d := append([]byte(nil), delim...)
+		next := make([]int, len(d))
+		for i, k := 1, 0; i < len(d); i++ {
+			for k > 0 && d[i] != d[k] {
+				k = next[k-1]
+			}
+			if d[i] == d[k] {
+				k++
+			}
+			next[i] = k
+		}
+		a.cfg.delim = d
+		a.cfg.delimNext = next
+		a.cfg.delimMatched = 0
+		return nil
+	}
+}
+
+// WithQueueDepth limits the number of filled buffers that can be queued
+// for the consumer to n, independently of the number of buffers.
+// When the queue is full the input is not read until the consumer
+// has picked up a buffer, which bounds how far ahead data is read,
+// while allowing many buffers to be used.
+// The depth is capped at the number of buffers.
+func WithQueueDepth(n int) Option {
+	return func(a *reader) error {
+		if n <= 0 {
+			return errors.New("queue depth must be positive")
+		}
+		a.queueDepth = n
+		return nil
+	}
+}
+
+// WithZeroOnReuse will zero buffers when their content has been consumed,
+// before they are filled again, and all buffers when the reader is closed,
+// and when data that has been read ahead is discarded by Seek or ResetSize.
+// This reduces the time sensitive data is kept in memory,
+// at the cost of clearing each buffer.
+// Slices returned by the reader are cleared when the next call is made.
+func WithZeroOnReuse() Option {
+	return func(a *reader) error {
+		a.zeroOnReuse = true
+		return nil
+	}
+}
+
+// WithConnUnblock will make Close set a read deadline in the past on the input,
+// if it has a SetReadDeadline method, like net.Conn.
+// This makes a read that is blocked waiting for data return,
+// so Close doesn't wait for data to arrive.
+// The input cannot be read afterwards without setting a new deadline.
+// For other inputs this has no effect.
+func WithConnUnblock() Option {
+	return func(a *reader) error {
+		a.connUnblock = true
+		return nil
+	}
+}
+
+// WithConsumerReadHistogram will record histograms of the buffer sizes
+// supplied to Read and the number of bytes returned.
+// They are available as ConsumerReadSizes and ConsumerReadBytes in Stats.
+// This can reveal consumers making small reads.
+func WithConsumerReadHistogram() Option {
+	return func(a *reader) error {
+		a.readHist = true
+		return nil
+	}
+}
+
+// WithReadTiming will record the time the async reader spends reading
+// from the input and waiting for buffers to read into,
+// which is returned by Stats as ReadTime and WaitTime.
+// This adds two calls to time.Now for each buffer.
+func WithReadTiming() Option {
+	return func(a *reader) error {
+		a.readTiming = true
+		return nil
+	}
+}
+
+// WithTotalTimeout limits the time the stream can be read to d,
+// starting from the first read.
+// When d has elapsed, reading ahead stops, and Read, WriteTo and the
+// other read methods return ErrTotalTimeout, even if data has been read ahead.
+// A read from the input that is in progress is not interrupted.
+// If a context is also supplied, for example with WriteToContext,
+// whichever expires first decides the error returned.
+func WithTotalTimeout(d time.Duration) Option {
+	return func(a *reader) error {
+		if d <= 0 {
+			return errors.New("total timeout must be positive")
+		}
+		a.totalTimeout = d
+		a.expired = make(chan struct{})
+		return nil
+	}
+}
+
+// WithHash will write all data returned to the consumer to h,
+// so a checksum of the stream can be calculated while reading it.
+// After a successful Seek the hash is reset to its initial state,
+// so the hash only covers data read after the last Seek.
+// ResetHash can be used to reset it manually.
+// h should not be used while the reader is being read.
+func WithHash(h hash.Hash) Option {
+	return func(a *reader) error {
+		if h == nil {
+			return errors.New("nil hash")
+		}
+		a.hash = h
+		return nil
+	}
+}
+
+// WithKernelReadahead will make the reader cooperate with the read-ahead
+// of the kernel when the input is an *os.File.
+// The kernel is told that the file is read sequentially,
+// and before each buffer is read, it is asked to start reading
+// the data that will fill the following buffers into the page cache,
+// so reads from the file are served from memory instead of waiting for the disk.
+// This is only supported on 64 bit Linux. On other platforms it has no effect.
+func WithKernelReadahead() Option {
+	return func(a *reader) error {
+		a.kernelAhead = true
+		return nil
+	}
+}
+
+// WithEOFCoupling will make Read return io.EOF along with the last data
+// of the input, when it is known that the input has ended,
+// instead of returning io.EOF on the following call.
+// This is allowed by the io.Reader contract, and saves a call to Read,
+// but callers must handle data returned with io.EOF.
+func WithEOFCoupling() Option {
+	return func(a *reader) error {
+		a.eofCoupling = true
+		return nil
+	}
+}
+
+// WithThreadLock will lock the async reader to a single OS thread
+// with runtime.LockOSThread while it is running.
+// This can help inputs that depend on thread-local state, like some cgo libraries,
+// or that benefit from staying on one CPU.
+// The thread is not used by other goroutines while locked, so each reader uses
+// an additional OS thread, and the async reader is restarted on a new thread
+// after Seek and similar calls.
+// The thread is unlocked when the async reader exits.
+func WithThreadLock() Option {
+	return func(a *reader) error {
+		a.threadLock = true
+		return nil
+	}
+}
+
+// WithPrefault will touch every memory page of the buffers when they are
+// allocated, before reading starts, so the first reads into the buffers
+// don't have to wait for the pages to be mapped.
+// This makes creating the reader slower, but reads more predictable,
+// which mostly matters for large buffers in latency sensitive code.
+// Buffers allocated later because of WithLazyBuffers are touched when allocated,
+// and buffers supplied by the caller are not touched.
+func WithPrefault() Option {
+	return func(a *reader) error {
+		a.prefault = true
+		return nil
+	}
+}
+
+// WithReleaseFunc will call fn with each buffer once the reader
+// is done with it, so buffers supplied with NewReaderBuffer can be returned to a pool.
+// fn is called for all buffers on Close, and for buffers that are no longer used
+// by Resize and ResetSize.
+// fn is called exactly once for each buffer, and only when the async reader
+// can no longer write to it.
+// Buffers allocated by the reader are also passed to fn.
+// Since the buffers are handed back, ResetSize after Close will allocate new buffers.
+func WithReleaseFunc(fn func(buf []byte)) Option {
+	return func(a *reader) error {
+		if fn == nil {
+			return errors.New("nil release function supplied")
+		}
+		a.release = fn
+		return nil
+	}
+}
+
+// WithBackpressureCallback will call fn when the reader changes between
+// being limited by the input and being limited by the consumer.
+// StateProducerBound is sent when the consumer has to wait for data,
+// StateConsumerBound when all buffers are filled and the async reader has to wait,
+// and StateBalanced when the waiting ends.
+// Only changes of the state are sent.
+// fn is called from the goroutine that is waiting, which can be the consumer
+// or the async reader, so it can be called concurrently and should return quickly.
+func WithBackpressureCallback(fn func(state State)) Option {
+	return func(a *reader) error {
+		if fn == nil {
+			return errors.New("nil backpressure callback supplied")
+		}
+		a.onState = fn
+		return nil
+	}
+}
+
+// WithConcurrencyCheck will make Read, WriteTo and Seek panic if they are
+// called while one of them is running on another goroutine.
+// Readers only support a single consumer, and concurrent use will
+// otherwise return corrupted data without warning.
+// This is meant for finding such misuse during development.
+// Calls that don't overlap in time are not detected, use the race detector for those.
+func WithConcurrencyCheck() Option {
+	return func(a *reader) error {
+		a.useCheck = true
+		return nil
+	}
+}
+
+// WithRightSizing will reduce the number and size of the buffers allocated
+// by the reader if they are much larger than needed for an input of expectedSize bytes.
+// This avoids allocating large buffers for small inputs.
+// Buffers are reduced to fit the input, but at least 2 buffers are kept,
+// if more were requested, so larger inputs are still read, just less efficiently.
+// Buffers supplied by the caller are not affected.
+func WithRightSizing(expectedSize int64) Option {
+	return func(a *reader) error {
+		if expectedSize < 0 {
+			return errors.New("expected size must not be negative")
+		}
+		a.rightSizing = true
+		a.expectedSize = expectedSize
+		return nil
+	}
+}
+
+// WithEOFError will make Read return err instead of io.EOF
+// when the end of the input has been reached.
+// This allows the end of the input to be told apart from io.EOF returned
+// by other readers, for example in layered protocols.
+//
+// The other methods returning io.EOF at the end of the input,
+// like ReadBuffer, ReadVec, ReadN, ReadAtLeast, ReadUntil and Peek,
+// and ReadAt of readers returned by NewReaderAt, also return err.
+//
+// WriteTo and its variants, including WriteToMulti, and ForEachBuffer will also
+// return err when the end of the input has been reached, instead of returning nil,
+// unless err is io.EOF.
+// This means that io.Copy will return err when everything has been copied.
+// DrainToEOF, ReadAllLimit and CloseDrain still return nil at the end of the input.
+func WithEOFError(err error) Option {
+	return func(a *reader) error {
+		if err == nil {
+			return errors.New("nil EOF error supplied")
+		}
+		if err != io.EOF {
+			a.eofErr = err
+		}
+		return nil
+	}
+}
+
+// WithSpill will read further ahead than the memory buffers allow,
+// by storing up to diskBuffers buffers of read-ahead data in a temporary file in dir.
+// The file is only written when all memory buffers are filled,
+// and data is read back from it into the memory buffers as they are consumed.
+// memBuffers replaces the number of buffers given to the constructor.
+// If dir is empty, the default directory for temporary files is used.
+//
+// The file is removed on Close. Seeking is not supported when spilling,
+// and WithRawReader and Detach cannot be used.
+func WithSpill(dir string, memBuffers, diskBuffers int) Option {
+	return func(a *reader) error {
+		if memBuffers <= 0 || diskBuffers <= 0 {
+			return errors.New("number of spill buffers must be positive")
+		}
+		a.spillDir = dir
+		a.spillMem = memBuffers
+		a.spillDisk = diskBuffers
+		return nil
+	}
+}
@@ -9,13 +9,27 @@
 // The readahead object also fulfills the io.WriterTo interface, which
 // is likely to speed up copies.
 //
+// Additional methods are available through the Reader
+// and SeekableReader interfaces.
+//
 // Package home: https://github.com/klauspost/readahead
 package readahead
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"math"
+	"os"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -24,8 +38,61 @@ const (
 
 	// DefaultBufferSize is the default buffer size, 1 MB.
 	DefaultBufferSize = 1 << 20
+
+	// Backoff between write retries.
+	minWriteBackoff = time.Millisecond
+	maxWriteBackoff = time.Second
+)
+
+// Defaults used when no size is given, changed by SetDefaults.
+var (
+	defaultsMu     sync.RWMutex
+	defaultBuffers = DefaultBuffers
+	defaultSize    = DefaultBufferSize
 )
 
+// SetDefaults changes the number of buffers and the buffer size used
+// by the constructors that don't take a size, like NewReader.
+// Readers that have already been created are not affected.
+// SetDefaults can be called concurrently with creating readers.
+func SetDefaults(buffers, size int) error {
+	if size <= 0 {
+		return fmt.Errorf("buffer size too small")
+	}
+	if buffers <= 0 {
+		return fmt.Errorf("number of buffers too small")
+	}
+	defaultsMu.Lock()
+	defaultBuffers, defaultSize = buffers, size
+	defaultsMu.Unlock()
+	return nil
+}
+
+// defaults returns the default number of buffers and buffer size.
+func defaults() (buffers, size int) {
+	defaultsMu.RLock()
+	defer defaultsMu.RUnlock()
+	return defaultBuffers, defaultSize
+}
+
+// ErrDrainLimit is returned by CloseDrain if the end of the input
+// was not reached within the limit.
+var ErrDrainLimit = errors.New("readahead: drain limit reached before EOF")
+
+// ErrLimitExceeded is returned by ReadAllLimit if the input
+// has more data than the limit.
+var ErrLimitExceeded = errors.New("readahead: input exceeds limit")
+
+// ErrTokenTooLong is returned by ReadUntilLimit if the delimiter
+// is not found within the limit.
+var ErrTokenTooLong = errors.New("readahead: token too long")
+
+// ErrClosed is returned when reading from a reader that has been closed.
+var ErrClosed = errors.New("readahead: read after Close")
+
+// ErrTotalTimeout is returned when the time set with WithTotalTimeout has elapsed.
+var ErrTotalTimeout = errors.New("readahead: total timeout exceeded")
+
 type seekable struct {
 	*reader
 }
@@ -35,9 +102,198 @@ type ReadSeekCloser interface {
 	io.Seeker
 }
 
+// Reader is implemented by all readers returned by this package,
+// except the one returned by NewBufferedReaderAt.
+// The constructors return the standard interfaces,
+// so a type assertion is used to get a Reader:
+//
+//	rd, err := readahead.NewReaderSize(in, 4, 1<<20)
+//	...
+//	rd.(readahead.Reader).SetPrefetchFactor(0.5)
+type Reader interface {
+	io.ReadCloser
+	io.WriterTo
+
+	// SetPrefetchFactor limits the buffers filled ahead to the fraction f of the buffers.
+	SetPrefetchFactor(f float64) error
+	// SetMaxLookahead limits the number of bytes read ahead to n.
+	SetMaxLookahead(n int64)
+	// SetAccessMode changes how far ahead is read to suit the access pattern.
+	SetAccessMode(mode AccessMode) error
+	// AccessMode returns the access mode set with SetAccessMode.
+	AccessMode() AccessMode
+	// Resize changes the number and size of the buffers without losing the read position.
+	Resize(buffers, size int) error
+	// ResetSize reuses a closed reader for a new input with new buffer sizes.
+	ResetSize(rd io.Reader, buffers, size int) error
+	// WaitSaturated waits until the input cannot be read further ahead.
+	WaitSaturated(ctx context.Context) error
+	// Prefetch reads the input into the buffers until it ends.
+	Prefetch(ctx context.Context) error
+
+	// ReadVec fills the supplied slices in order.
+	ReadVec(bufs ...[]byte) (n int, err error)
+	// ReadAtLeast reads into p until at least min bytes have been read.
+	ReadAtLeast(p []byte, min int) (n int, err error)
+	// ReadN reads and returns the next n bytes.
+	ReadN(n int) ([]byte, error)
+	// ReadUntil reads until and including the first occurrence of delim.
+	ReadUntil(delim byte) ([]byte, error)
+	// ReadUntilLimit is like ReadUntil, but reads at most max bytes.
+	ReadUntilLimit(delim byte, max int) (token []byte, err error)
+	// ReadBuffer returns the remaining data of the current buffer without copying.
+	ReadBuffer() ([]byte, error)
+	// Peek returns the next n bytes without advancing the reader.
+	Peek(n int) ([]byte, error)
+	// PeekAvailable returns a copy of the data that has been read ahead.
+	PeekAvailable() []byte
+	// NextSize returns the size of the data the next ReadBuffer returns without waiting.
+	NextSize() (int, bool)
+
+	// Buffered returns the number of bytes that have been read ahead.
+	Buffered() int
+	// Free returns how many more bytes can be read ahead.
+	Free() int
+	// Idle returns the number of empty buffers waiting to be filled.
+	Idle() int
+	// Offset returns the number of bytes returned to the consumer so far.
+	Offset() int64
+	// Remaining returns the number of bytes left before the end of the input, or -1.
+	Remaining() int64
+	// Stats returns statistics about the reader.
+	Stats() Stats
+	// Name returns the name set with WithName.
+	Name() string
+
+	// WriteToFunc writes data to w like WriteTo, and reports the progress.
+	WriteToFunc(w io.Writer, progress func(written int64)) (n int64, err error)
+	// WriteToContext writes data to w like WriteTo, until ctx is done.
+	WriteToContext(ctx context.Context, w io.Writer) (n int64, err error)
+	// WriteToN writes up to n bytes to w like WriteTo.
+	WriteToN(w io.Writer, n int64) (written int64, err error)
+	// WriteToMulti writes the data to all writers.
+	WriteToMulti(ws ...io.Writer) (n int64, err error)
+	// ForEachBuffer calls fn with the data of each buffer.
+	ForEachBuffer(ctx context.Context, fn func(b []byte) error) error
+
+	// ClearError clears an error returned by the input and continues reading.
+	ClearError() error
+	// Clone returns a new reader reading ahead from the current position.
+	Clone() (ReadSeekCloser, error)
+	// ResetHash resets the hash set with WithHash.
+	ResetHash()
+	// WithRawReader pauses reading ahead and calls fn with the input.
+	WithRawReader(fn func(in io.Reader) error) error
+	// As sets target to the input, if it can be assigned to it.
+	As(target interface{}) bool
+	// Detach stops reading ahead and returns the input and the data read ahead.
+	Detach() (in io.Reader, leftover []byte, err error)
+	// DrainToEOF reads and discards the remaining input.
+	DrainToEOF() (n int64, err error)
+	// ReadAllLimit reads until the end of the input, up to max bytes.
+	ReadAllLimit(max int64) ([]byte, error)
+	// CloseDrain discards the remaining input and closes the reader.
+	CloseDrain(max int64) error
+}
+
+// SeekableReader is implemented by the readers returned by this package
+// that read from an io.ReadSeeker.
+// The constructors return ReadSeekCloser, which can be asserted to SeekableReader.
+type SeekableReader interface {
+	Reader
+	io.Seeker
+
+	// WriteRange writes length bytes starting at offset off to w.
+	WriteRange(w io.Writer, off, length int64) (int64, error)
+}
+
+var (
+	_ Reader         = (*reader)(nil)
+	_ SeekableReader = (*seekable)(nil)
+)
+
+// IsSeekable returns whether r is a reader returned by this package
+// that supports seeking.
+// It returns false for readers not created by this package.
+func IsSeekable(r io.ReadCloser) bool {
+	switch r.(type) {
+	case *seekable, *seekableReaderAt, *prefetchReaderAt:
+		return true
+	}
+	return false
+}
+
+// ReadError is returned when the input has returned an error other than io.EOF.
+// Offset is the number of bytes returned before the error,
+// which can be used to resume reading.
+type ReadError struct {
+	Err    error // Error returned by the input
+	Offset int64 // Offset of the error in the stream
+}
+
+func (e *ReadError) Error() string {
+	return fmt.Sprintf("readahead: read error at offset %d: %v", e.Offset, e.Err)
+}
+
+// Unwrap returns the error returned by the input.
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// State is the backpressure state of a reader,
+// see WithBackpressureCallback.
+type State int
+
+const (
+	// StateBalanced means neither side is waiting for the other.
+	StateBalanced State = iota
+	// StateProducerBound means all buffers are empty and the consumer
+	// is waiting for data from the input.
+	StateProducerBound
+	// StateConsumerBound means all buffers are full and the async reader
+	// is waiting for the consumer.
+	StateConsumerBound
+)
+
+// String returns the name of the state.
+func (s State) String() string {
+	switch s {
+	case StateBalanced:
+		return "balanced"
+	case StateProducerBound:
+		return "producer-bound"
+	case StateConsumerBound:
+		return "consumer-bound"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// AccessMode is the expected access pattern of a reader,
+// see SetAccessMode.
+type AccessMode int
+
+const (
+	// AccessSequential reads ahead into all buffers.
+	// This is the default.
+	AccessSequential AccessMode = iota
+	// AccessRandom reads at most one buffer ahead,
+	// since seeks would discard more, and hands over data after each read.
+	AccessRandom
+)
+
 type reader struct {
+	offset  int64         // Consumer position, accessed atomically. Keep first for alignment.
+	noFetch uint64        // 1 - prefetch factor as float64 bits, accessed atomically.
+	lookMax int64         // Max bytes to read ahead if > 0, accessed atomically.
+	peekMin int64         // Bytes Peek needs read ahead, allowed beyond lookMax, accessed atomically.
+	filled  int64         // Bytes handed to the consumer by the async reader, accessed atomically.
+	fillMax int64         // Max value of filled if > 0, accessed atomically.
+	used    int64         // Bytes consumed, accessed atomically.
+	inUse   int32         // 1 while a checked method is running, accessed atomically.
+	state   int32         // Backpressure State, accessed atomically.
 	in      io.Reader     // Input reader
 	closer  io.Closer     // Optional closer
+	closers []io.Closer   // Additional closers, called after closer
 	ready   chan *buffer  // Buffers ready to be handed to the reader
 	reuse   chan *buffer  // Buffers to reuse for input reading
 	exit    chan struct{} // Closes when finished
@@ -46,11 +302,75 @@ type reader struct {
 	err     error         // If an error has occurred it is here
 	cur     *buffer       // Current buffer being served
 	exited  chan struct{} // Channel is closed been the async reader shuts down
+	notify  chan struct{} // Signalled when a buffer has been handed over
+	wake    chan struct{} // Signalled when the async reader may be able to prefetch more
 	bufs    [][]byte
+	pending []*buffer // Buffers taken from ready, served before ready
+	held    *buffer   // Filled buffer the async reader could not hand over before exiting
+	peekBuf []byte    // Scratch space for Peek across buffers
+	closed  bool      // Close has been called
+
+	closeOnce sync.Once
+	closing   chan struct{} // Closed when Close is called
+	readMu    sync.Mutex    // Held by Read, so Close waits for it to return
+	limit     int64         // Bytes left in an io.LimitedReader input at start, or -1
+	limitBase int64         // Bytes consumed when limit was recorded
+
+	// Options
+	failFast      bool                          // Return input errors as soon as they are seen
+	lazy          bool                          // Allocate buffers after the first one has been filled
+	recordSize    int                           // If > 0, Read returns whole records of this size
+	fillFn        func(buf []byte) (int, error) // Used instead of in.Read if set
+	lazyStart     bool                          // Don't start reading until data is requested
+	name          string                        // Name for identification
+	launch        func(async bool)              // Starts the async reader if lazily started
+	onState       func(state State)             // Called on backpressure transitions if set
+	writeRetry    func(err error) bool          // Retry failed writes in WriteTo if it returns true
+	writeReady    <-chan struct{}               // If set, WriteTo waits for it when a write would block
+	writeCoalesce int                           // If > 0, combine ready buffers up to this size in WriteTo
+	noCoalesce    bool                          // Never combine data from several buffers
+	queueDepth    int                           // If > 0, capacity of the ready queue
+	zeroOnReuse   bool                          // Zero buffers when they have been consumed and on Close
+	connUnblock   bool                          // Set a read deadline on the input on Close
+	readHist      bool                          // Record histograms of consumer reads
+	totalTimeout  time.Duration                 // If > 0, max time from the first read
+	expireTimer   *time.Timer                   // Closes expired when totalTimeout has elapsed
+	expired       chan struct{}                 // Closed when totalTimeout has elapsed
+	hash          hash.Hash                     // If set, data returned to the consumer is written to it
+	kernelAhead   bool                          // Ask the kernel to read ahead of the async reader
+	unblock       func()                        // If set, called on Close to unblock reads from the input
+	eofCoupling   bool                          // Return io.EOF with the last data in Read
+	spillDir      string                        // Directory for the spill file
+	spillMem      int                           // If > 0, number of memory buffers when spilling
+	spillDisk     int                           // Number of buffers in the spill file
+	threadLock    bool                          // Lock the async reader to an OS thread
+	prefault      bool                          // Touch all pages of allocated buffers
+	readTiming    bool                          // Record time spent reading and waiting in the async reader
+	release       func(buf []byte)              // If set, called when a buffer is no longer used
+	useCheck      bool                          // Panic on concurrent use
+	rightSizing   bool                          // Allocate buffers for an input of expectedSize
+	expectedSize  int64                         // Expected size of the input
+	eofErr        error                         // If set, returned instead of io.EOF, see WithEOFError
+	cfg           readConfig
+
+	// Cached input size for seeking relative to the end.
+	sizeCache   bool
+	sizeRefresh time.Duration // Re-probe when older than this. 0 means never.
+	sizeKnown   bool
+	sizeEnd     int64
+	sizeTime    time.Time
+
+	mu       sync.Mutex // Protects fields below, shared with the async reader
+	srcErr   error      // Error returned by the input, if any
+	queued   []*buffer  // Buffers sent to ready, not yet received by the consumer
+	stats    Stats
+	begin    time.Time // When the reader was created
+	gotFirst bool      // First buffer has been read
 }
 
 // NewReader returns a reader that will asynchronously read from
-// the supplied reader into 4 buffers of 1MB each.
+// the supplied reader into 4 buffers of 1MB each,
+// or the defaults set with SetDefaults.
 //
 // It will start reading from the input at once, maybe even before this
 // function has returned.
@@ -64,7 +384,8 @@ func NewReader(rd io.Reader) io.ReadCloser {
 		return nil
 	}
 
-	ret, err := NewReaderSize(rd, DefaultBuffers, DefaultBufferSize)
+	buffers, size := defaults()
+	ret, err := NewReaderSize(rd, buffers, size)
 
 	// Should not be possible to trigger from other packages.
 	if err != nil {
@@ -74,7 +395,8 @@ func NewReader(rd io.Reader) io.ReadCloser {
 }
 
 // NewReadCloser returns a reader that will asynchronously read from
-// the supplied reader into 4 buffers of 1MB each.
+// the supplied reader into 4 buffers of 1MB each,
+// or the defaults set with SetDefaults.
 //
 // It will start reading from the input at once, maybe even before this
 // function has returned.
@@ -89,7 +411,8 @@ func NewReadCloser(rd io.ReadCloser) io.ReadCloser {
 		return nil
 	}
 
-	ret, err := NewReadCloserSize(rd, DefaultBuffers, DefaultBufferSize)
+	buffers, size := defaults()
+	ret, err := NewReadCloserSize(rd, buffers, size)
 
 	// Should not be possible to trigger from other packages.
 	if err != nil {
@@ -99,7 +422,8 @@ func NewReadCloser(rd io.ReadCloser) io.ReadCloser {
 }
 
 // NewReadSeeker returns a reader that will asynchronously read from
-// the supplied reader into 4 buffers of 1MB each.
+// the supplied reader into 4 buffers of 1MB each,
+// or the defaults set with SetDefaults.
 //
 // It will start reading from the input at once, maybe even before this
 // function has returned.
@@ -113,7 +437,8 @@ func NewReadSeeker(rd io.ReadSeeker) ReadSeekCloser {
 }
 
 // NewReadSeekCloser returns a reader that will asynchronously read from
-// the supplied reader into 4 buffers of 1MB each.
+// the supplied reader into 4 buffers of 1MB each,
+// or the defaults set with SetDefaults.
 //
 // It will start reading from the input at once, maybe even before this
 // function has returned.
@@ -130,7 +455,10 @@ func NewReadSeekCloser(rd ReadSeekCloser) ReadSeekCloser {
 // NewReaderSize returns a reader with a custom number of buffers and size.
 // buffers is the number of queued buffers and size is the size of each
 // buffer in bytes.
-func NewReaderSize(rd io.Reader, buffers, size int) (res io.ReadCloser, err error) {
+// A single buffer works, but gives no concurrency benefit, since the input
+// is not read while the consumer is reading the buffer.
+// Options can be supplied to change the behaviour of the reader.
+func NewReaderSize(rd io.Reader, buffers, size int, opts ...Option) (res io.ReadCloser, err error) {
 	if size <= 0 {
 		return nil, fmt.Errorf("buffer size too small")
 	}
@@ -141,6 +469,9 @@ func NewReaderSize(rd io.Reader, buffers, size int) (res io.ReadCloser, err erro
 		return nil, fmt.Errorf("nil input reader supplied")
 	}
 	a := &reader{}
+	if err := a.setOptions(opts); err != nil {
+		return nil, err
+	}
 	if _, ok := rd.(io.Seeker); ok {
 		res = &seekable{a}
 	} else {
@@ -150,10 +481,44 @@ func NewReaderSize(rd io.Reader, buffers, size int) (res io.ReadCloser, err erro
 	return
 }
 
+// ContextReader is an input that supports cancelling reads with a context.
+type ContextReader interface {
+	ReadContext(ctx context.Context, p []byte) (n int, err error)
+}
+
+// NewContextSourceReader returns a reader with a custom number of buffers and size,
+// that reads from rd using ReadContext.
+// The context supplied to ReadContext is derived from ctx,
+// and is cancelled when the reader is closed,
+// so Close doesn't wait for blocked reads from rd.
+// If ctx is cancelled, the error returned by rd is returned when reading.
+// Options can be supplied to change the behaviour of the reader.
+func NewContextSourceReader(rd ContextReader, ctx context.Context, buffers, size int, opts ...Option) (io.ReadCloser, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("buffer size too small")
+	}
+	if buffers <= 0 {
+		return nil, fmt.Errorf("number of buffers too small")
+	}
+	if rd == nil {
+		return nil, fmt.Errorf("nil input reader supplied")
+	}
+	a := &reader{}
+	if err := a.setOptions(opts); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	a.unblock = cancel
+	a.init(readerFunc(func(p []byte) (int, error) {
+		return rd.ReadContext(ctx, p)
+	}), buffers, size)
+	return a, nil
+}
+
 // NewReaderBuffer returns a reader with a custom number of buffers and size.
 // All buffers must be the same size.
 // Buffers can be reused after Close has been called.
-func NewReaderBuffer(rd io.Reader, buffers [][]byte) (res io.ReadCloser, err error) {
+func NewReaderBuffer(rd io.Reader, buffers [][]byte, opts ...Option) (res io.ReadCloser, err error) {
 	if len(buffers) == 0 {
 		return nil, fmt.Errorf("number of buffers too small")
 	}
@@ -173,12 +538,15 @@ func NewReaderBuffer(rd io.Reader, buffers [][]byte) (res io.ReadCloser, err err
 		return nil, fmt.Errorf("nil input reader supplied")
 	}
 	a := &reader{}
+	if err := a.setOptions(opts); err != nil {
+		return nil, err
+	}
 	if _, ok := rd.(io.Seeker); ok {
 		res = &seekable{a}
 	} else {
 		res = a
 	}
-	a.initBuffers(rd, buffers, sz)
+	a.initBuffers(rd, buffers, len(buffers), sz)
 
 	return
 }
@@ -186,7 +554,7 @@ func NewReaderBuffer(rd io.Reader, buffers [][]byte) (res io.ReadCloser, err err
 // NewReadCloserSize returns a reader with a custom number of buffers and size.
 // buffers is the number of queued buffers and size is the size of each
 // buffer in bytes.
-func NewReadCloserSize(rc io.ReadCloser, buffers, size int) (res io.ReadCloser, err error) {
+func NewReadCloserSize(rc io.ReadCloser, buffers, size int, opts ...Option) (res io.ReadCloser, err error) {
 	if size <= 0 {
 		return nil, fmt.Errorf("buffer size too small")
 	}
@@ -197,6 +565,9 @@ func NewReadCloserSize(rc io.ReadCloser, buffers, size int) (res io.ReadCloser,
 		return nil, fmt.Errorf("nil input reader supplied")
 	}
 	a := &reader{closer: rc}
+	if err := a.setOptions(opts); err != nil {
+		return nil, err
+	}
 	if _, ok := rc.(io.Seeker); ok {
 		res = &seekable{a}
 	} else {
@@ -209,7 +580,7 @@ func NewReadCloserSize(rc io.ReadCloser, buffers, size int) (res io.ReadCloser,
 // NewReadCloserBuffer returns a reader with a custom number of buffers and size.
 // All buffers must be the same size.
 // Buffers can be reused after Close has been called.
-func NewReadCloserBuffer(rc io.ReadCloser, buffers [][]byte) (res io.ReadCloser, err error) {
+func NewReadCloserBuffer(rc io.ReadCloser, buffers [][]byte, opts ...Option) (res io.ReadCloser, err error) {
 	if len(buffers) == 0 {
 		return nil, fmt.Errorf("number of buffers too small")
 	}
@@ -230,20 +601,23 @@ func NewReadCloserBuffer(rc io.ReadCloser, buffers [][]byte) (res io.ReadCloser,
 		return nil, fmt.Errorf("nil input reader supplied")
 	}
 	a := &reader{closer: rc}
+	if err := a.setOptions(opts); err != nil {
+		return nil, err
+	}
 	if _, ok := rc.(io.Seeker); ok {
 		res = &seekable{a}
 	} else {
 		res = a
 	}
-	a.initBuffers(rc, buffers, sz)
+	a.initBuffers(rc, buffers, len(buffers), sz)
 	return
 }
 
 // NewReadSeekerSize returns a reader with a custom number of buffers and size.
 // buffers is the number of queued buffers and size is the size of each
 // buffer in bytes.
-func NewReadSeekerSize(rd io.ReadSeeker, buffers, size int) (res ReadSeekCloser, err error) {
-	reader, err := NewReaderSize(rd, buffers, size)
+func NewReadSeekerSize(rd io.ReadSeeker, buffers, size int, opts ...Option) (res ReadSeekCloser, err error) {
+	reader, err := NewReaderSize(rd, buffers, size, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -252,11 +626,35 @@ func NewReadSeekerSize(rd io.ReadSeeker, buffers, size int) (res ReadSeekCloser,
 	return
 }
 
+// NewReadSeekerAt returns a reader like NewReadSeekerSize,
+// which starts reading ahead at startOffset.
+// The input is seeked to startOffset before anything is read,
+// so no data before startOffset is read.
+// An error is returned if the input cannot seek to startOffset.
+func NewReadSeekerAt(rd io.ReadSeeker, startOffset int64, buffers, size int, opts ...Option) (ReadSeekCloser, error) {
+	if rd == nil {
+		return nil, fmt.Errorf("nil input reader supplied")
+	}
+	pos, err := rd.Seek(startOffset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	if pos != startOffset {
+		return nil, fmt.Errorf("readahead: seek to %d returned position %d", startOffset, pos)
+	}
+	res, err := NewReadSeekerSize(rd, buffers, size, opts...)
+	if err != nil {
+		return nil, err
+	}
+	atomic.StoreInt64(&res.(*seekable).offset, startOffset)
+	return res, nil
+}
+
 // NewReadSeekCloserSize returns a reader with a custom number of buffers and size.
 // buffers is the number of queued buffers and size is the size of each
 // buffer in bytes.
-func NewReadSeekCloserSize(rd ReadSeekCloser, buffers, size int) (res ReadSeekCloser, err error) {
-	reader, err := NewReadCloserSize(rd, buffers, size)
+func NewReadSeekCloserSize(rd ReadSeekCloser, buffers, size int, opts ...Option) (res ReadSeekCloser, err error) {
+	reader, err := NewReadCloserSize(rd, buffers, size, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -268,8 +666,8 @@ func NewReadSeekCloserSize(rd ReadSeekCloser, buffers, size int) (res ReadSeekCl
 // NewReadSeekCloserBuffer returns a reader with a custom number of buffers and size.
 // All buffers must be the same size.
 // Buffers can be reused after Close has been called.
-func NewReadSeekCloserBuffer(rd ReadSeekCloser, buffers [][]byte) (res ReadSeekCloser, err error) {
-	reader, err := NewReadCloserBuffer(rd, buffers)
+func NewReadSeekCloserBuffer(rd ReadSeekCloser, buffers [][]byte, opts ...Option) (res ReadSeekCloser, err error) {
+	reader, err := NewReadCloserBuffer(rd, buffers, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -280,242 +678,2372 @@ func NewReadSeekCloserBuffer(rd ReadSeekCloser, buffers [][]byte) (res ReadSeekC
 
 // initialize the reader
 func (a *reader) init(rd io.Reader, buffers, size int) {
-	x := make([]byte, buffers*size)
-	bufs := make([][]byte, buffers)
+	if a.spillMem > 0 {
+		buffers = a.spillMem
+	}
+	if a.rightSizing {
+		buffers, size = rightSize(a.expectedSize, buffers, size)
+	}
+	n := buffers
+	if a.lazy {
+		// Allocate the rest when needed.
+		n = 1
+	}
+	x := make([]byte, n*size)
+	if a.prefault {
+		prefault(x)
+	}
+	bufs := make([][]byte, n)
 	for i := range bufs {
 		bufs[i] = x[i*size : (i+1)*size : (i+1)*size]
 	}
-	a.initBuffers(rd, bufs, size)
+	a.initBuffers(rd, bufs, buffers, size)
 }
 
-// initialize the reader
-func (a *reader) initBuffers(rd io.Reader, buffers [][]byte, size int) {
+// initialize the reader.
+// n is the total number of buffers. If there are fewer buffers supplied,
+// the remaining will be allocated once the first buffer has been filled.
+func (a *reader) initBuffers(rd io.Reader, buffers [][]byte, n, size int) {
+	if _, ok := rd.(*spillReader); !ok && a.spillMem > 0 {
+		rd = newSpillReader(rd, a.spillDir, a.spillDisk, size)
+	}
 	a.in = rd
-	a.ready = make(chan *buffer, len(buffers))
-	a.reuse = make(chan *buffer, len(buffers))
-	a.exit = make(chan struct{}, 0)
-	a.exited = make(chan struct{}, 0)
-	a.buffers = len(buffers)
+	a.buffers = n
 	a.size = size
 	a.cur = nil
 	a.err = nil
 	a.bufs = buffers
+	a.pending = nil
+	a.held = nil
+	a.cfg.delimMatched = 0
+	a.closing = make(chan struct{})
+	a.limit = -1
+	if lr, ok := rd.(*io.LimitedReader); ok {
+		// N cannot be read once the async reader has started.
+		a.limit = lr.N
+		a.limitBase = atomic.LoadInt64(&a.used)
+	}
 
 	// Create buffers
-	for _, buf := range buffers {
-		a.reuse <- newBuffer(buf)
+	idle := make([]*buffer, len(buffers))
+	for i, buf := range buffers {
+		idle[i] = newBuffer(buf)
 	}
+	a.start(idle, nil)
+}
 
-	// Start async reader
-	go func() {
-		// Ensure that when we exit this is signalled.
-		defer close(a.exited)
-		defer close(a.ready)
-		var atEOF bool
-		for {
-			select {
-			case b := <-a.reuse:
-				if atEOF {
-					// Return delay
-					b.err = io.EOF
-					b.buf = b.buf[:0]
-					b.offset = 0
-					a.ready <- b
-					return
-				}
-				err := b.read(a.in)
-				// Delay EOF if we have content.
-				if err == io.EOF && len(b.buf) > 0 {
-					atEOF = true
-					err = nil
-					b.err = nil
-				}
-				a.ready <- b
-				if err != nil {
-					return
-				}
-			case <-a.exit:
+// start the async reader with the supplied empty buffers.
+// If term is non-nil the input will not be read,
+// and term will be returned on the first buffer.
+// With lazy start the async reader is started on first use.
+func (a *reader) start(idle []*buffer, term error) {
+	depth := a.buffers
+	if a.queueDepth > 0 && a.queueDepth < depth {
+		depth = a.queueDepth
+	}
+	a.ready = make(chan *buffer, depth)
+	a.reuse = make(chan *buffer, a.buffers)
+	a.exit = make(chan struct{}, 0)
+	a.exited = make(chan struct{}, 0)
+	a.notify = make(chan struct{}, 1)
+	if a.wake == nil {
+		a.wake = make(chan struct{}, 1)
+	}
+	a.mu.Lock()
+	a.srcErr = term
+	a.queued = nil
+	if a.begin.IsZero() {
+		a.begin = time.Now()
+	}
+	a.mu.Unlock()
+
+	for _, b := range idle {
+		a.reuse <- b
+	}
+	// Data that has been read ahead is kept.
+	atomic.StoreInt64(&a.filled, atomic.LoadInt64(&a.used)+a.readAhead())
+	grow := a.buffers - len(a.bufs)
+	var src io.Reader = a.in
+	if a.fillFn != nil {
+		src = readerFunc(a.fillFn)
+	}
+
+	var advise func(length int64)
+	if a.kernelAhead && a.fillFn == nil {
+		advise = kernelAdvisor(a.in)
+	}
+
+	if a.lazyStart {
+		a.launch = func(async bool) {
+			if async {
+				go a.run(src, grow, term, advise)
 				return
 			}
+			a.runFirst(src, grow, term, advise)
 		}
-	}()
+		return
+	}
+	go a.run(src, grow, term, advise)
 }
 
-// fill will check if the current buffer is empty and fill it if it is.
-// If an error was returned at the end of the current buffer it is returned.
-func (a *reader) fill() (err error) {
-	if a.cur.isEmpty() {
-		if a.cur != nil {
-			a.reuse <- a.cur
-			a.cur = nil
+// run is the async reader.
+// It reads from src into buffers from reuse and sends them to ready.
+// If grow > 0 the remaining buffers are allocated after the first read.
+// If term is non-nil the input will not be read,
+// and term will be returned on the first buffer.
+// If advise is non-nil it is called before each read with the number
+// of bytes that will be read ahead.
+func (a *reader) run(src io.Reader, grow int, term error, advise func(length int64)) {
+	if a.threadLock {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+	// Ensure that when we exit this is signalled.
+	defer close(a.exited)
+	defer close(a.ready)
+	spill, _ := a.in.(*spillReader)
+	for {
+		var waitStart time.Time
+		if a.readTiming {
+			waitStart = time.Now()
 		}
-		b, ok := <-a.ready
-		if !ok {
-			if a.err == nil {
-				a.err = errors.New("readahead: read after Close")
+		if len(a.reuse) == 0 {
+			a.enterState(StateConsumerBound)
+			if spill != nil {
+				// Read further ahead into the spill file.
+				spill.setFull(true)
 			}
-			return a.err
 		}
-		a.cur = b
+		select {
+		case b := <-a.reuse:
+			a.leaveState(StateConsumerBound)
+			if spill != nil {
+				spill.setFull(false)
+			}
+			if !a.fillBuffer(b, src, &grow, &term, advise, waitStart) {
+				return
+			}
+		case <-a.exit:
+			return
+		case <-a.expired:
+			return
+		}
 	}
-	return nil
 }
 
-// Read will return the next available data.
-func (a *reader) Read(p []byte) (n int, err error) {
-	if a.err != nil {
-		return 0, a.err
+// runFirst fills the first buffer on the calling goroutine,
+// and only starts the async reader if there is more to read.
+// This avoids starting a goroutine for small inputs that are read
+// in a single call to the input.
+func (a *reader) runFirst(src io.Reader, grow int, term error, advise func(length int64)) {
+	var waitStart time.Time
+	if a.readTiming {
+		waitStart = time.Now()
 	}
-	// Swap buffer and maybe return error
-	err = a.fill()
-	if err != nil {
-		return 0, err
+	done := func() {
+		close(a.ready)
+		close(a.exited)
 	}
-
-	// Copy what we can
-	n = copy(p, a.cur.buffer())
-	a.cur.inc(n)
-
-	if a.cur.isEmpty() {
-		// Return current, so a fetch can start.
-		if a.cur != nil {
-			// If at end of buffer, return any error, if present
-			a.err = a.cur.err
-			a.reuse <- a.cur
-			a.cur = nil
+	select {
+	case b := <-a.reuse:
+		if !a.fillBuffer(b, src, &grow, &term, advise, waitStart) {
+			done()
+			return
 		}
-		return n, a.err
+	default:
 	}
-	return n, nil
+	if term != nil && len(a.ready) < cap(a.ready) {
+		// The input ended with the first buffer.
+		// Hand over the error as well, if there is room for it.
+		select {
+		case b := <-a.reuse:
+			a.fillBuffer(b, src, &grow, &term, advise, waitStart)
+			done()
+			return
+		default:
+		}
+	}
+	go a.run(src, grow, term, advise)
 }
 
-func (a *seekable) Seek(offset int64, whence int) (res int64, err error) {
-	//Not checking the result as seekable receiver guarantees it to be assertable
-	seeker, _ := a.in.(io.Seeker)
-	//Make sure the async routine is closed
-	select {
-	case <-a.exited:
-	case a.exit <- struct{}{}:
-		<-a.exited
+// fillBuffer reads from src into b and sends it to the consumer.
+// It returns false if the async reader should exit.
+func (a *reader) fillBuffer(b *buffer, src io.Reader, grow *int, term *error, advise func(length int64), waitStart time.Time) bool {
+	if *term != nil {
+		// Return delayed error
+		b.err = *term
+		b.buf = b.buf[:0]
+		b.offset = 0
+		a.send(b)
+		return false
 	}
-	if whence == io.SeekCurrent {
-		//If need to seek based on current position, take into consideration the bytes we read but the consumer
-		//doesn't know about
+	if !a.throttle() {
+		// Keep the buffer for a restart.
+		a.reuse <- b
+		return false
+	}
+	if advise != nil {
+		advise(int64(a.buffers) * int64(a.size))
+	}
+	var readStart time.Time
+	if a.readTiming {
+		readStart = time.Now()
+	}
+	err := b.read(src, &a.cfg, a.closing, a.expired)
+	a.mu.Lock()
+	if a.readTiming {
+		a.stats.ReadTime += time.Since(readStart)
+		a.stats.WaitTime += readStart.Sub(waitStart)
+	}
+	if err != nil {
+		a.srcErr = err
+	}
+	if !a.gotFirst {
+		a.gotFirst = true
+		a.stats.FirstByteLatency = time.Since(a.begin)
+	}
+	a.stats.Retries += int64(b.retries)
+	a.mu.Unlock()
+	// Delay EOF if we have content.
+	if err == io.EOF && len(b.buf) > 0 {
+		*term = io.EOF
 		err = nil
-		for {
-			if err = a.fill(); err == nil && a.cur != nil {
-				offset -= int64(len(a.cur.buffer()))
-				a.cur.offset = len(a.cur.buf)
-			}
-			if a.cur == nil {
-				break
-			}
+		b.err = nil
+		b.last = true
+	}
+	if *grow > 0 && err == nil && *term == nil {
+		// More than one buffer is needed, allocate the rest.
+		// bufs is only accessed by the consumer when we have exited.
+		x := make([]byte, *grow*a.size)
+		if a.prefault {
+			prefault(x)
 		}
+		for i := 0; i < *grow; i++ {
+			buf := x[i*a.size : (i+1)*a.size : (i+1)*a.size]
+			a.bufs = append(a.bufs, buf)
+			a.reuse <- newBuffer(buf)
+		}
+		*grow = 0
 	}
-	//Seek the actual Seeker
-	if res, err = seeker.Seek(offset, whence); err == nil {
-		//If the seek was successful, reinitalize ourselves (with the new position).
-		a.initBuffers(a.in, a.bufs, a.size)
+	atomic.AddInt64(&a.filled, int64(len(b.buf)))
+	if !a.send(b) {
+		return false
 	}
-	return
+	select {
+	case a.notify <- struct{}{}:
+	default:
+	}
+	return err == nil
 }
 
-// WriteTo writes data to w until there's no more data to write or when an error occurs.
-// The return value n is the number of bytes written.
-// Any error encountered during the write is also returned.
-func (a *reader) WriteTo(w io.Writer) (n int64, err error) {
-	if a.err != nil {
-		return 0, a.err
-	}
-	n = 0
+// throttle waits until the number of buffers waiting for the consumer
+// is below the limit set by SetPrefetchFactor,
+// and the number of bytes read ahead is below the limit set by SetMaxLookahead.
+// It returns false if exit is signalled while waiting.
+func (a *reader) throttle() bool {
 	for {
-		err = a.fill()
-		if err != nil {
-			return n, err
+		f := 1 - math.Float64frombits(atomic.LoadUint64(&a.noFetch))
+		max := atomic.LoadInt64(&a.lookMax)
+		filled, fillMax := atomic.LoadInt64(&a.filled), atomic.LoadInt64(&a.fillMax)
+		ahead := filled - atomic.LoadInt64(&a.used)
+		limit := int(math.Ceil(f * float64(a.buffers)))
+		if limit > 1 && AccessMode(atomic.LoadInt32(&a.cfg.mode)) == AccessRandom {
+			limit = 1
 		}
-		n2, err := w.Write(a.cur.buffer())
-		a.cur.inc(n2)
-		n += int64(n2)
-		if err != nil {
-			return n, err
+		if len(a.ready) < limit && (max <= 0 || ahead < max || ahead < atomic.LoadInt64(&a.peekMin)) && (fillMax <= 0 || filled < fillMax) {
+			return true
 		}
-		if a.cur.err != nil {
-			// io.Writer should return nil if we are at EOF.
-			if a.cur.err == io.EOF {
-				a.err = a.cur.err
-				return n, nil
-			}
-			a.err = a.cur.err
-			return n, a.cur.err
+		select {
+		case <-a.wake:
+		case <-a.exit:
+			return false
+		case <-a.expired:
+			return false
+		case <-a.closing:
+			return false
 		}
 	}
 }
 
-// Close will ensure that the underlying async reader is shut down.
-// It will also close the input supplied on newAsyncReader.
-func (a *reader) Close() (err error) {
-	select {
-	case <-a.exited:
-	case a.exit <- struct{}{}:
-		<-a.exited
+// SetPrefetchFactor limits the number of buffers the async reader keeps
+// filled ahead of the consumer to the fraction f of the buffers.
+// f must be between 0 and 1, where 1 (the default) reads ahead into all buffers
+// and 0 pauses reading ahead.
+// While paused, reads that need more data block until the factor is raised.
+// SetPrefetchFactor can be called concurrently with reads.
+func (a *reader) SetPrefetchFactor(f float64) error {
+	if !(f >= 0 && f <= 1) {
+		return errors.New("prefetch factor must be between 0 and 1")
+	}
+	atomic.StoreUint64(&a.noFetch, math.Float64bits(1-f))
+	a.signalWake()
+	return nil
+}
+
+// SetMaxLookahead limits the number of bytes read ahead of the consumer to n.
+// The limit is checked before each buffer is filled,
+// so up to one buffer more than n may be read ahead.
+// If n <= 0 (the default) only the number of buffers limits reading ahead.
+// Lowering the limit below what has been read ahead keeps the data,
+// and reading ahead continues when the consumer has caught up.
+// Peek reads ahead past the limit if it needs more data.
+// SetMaxLookahead can be called concurrently with reads.
+func (a *reader) SetMaxLookahead(n int64) {
+	atomic.StoreInt64(&a.lookMax, n)
+	a.signalWake()
+}
+
+// SetAccessMode changes how far the reader reads ahead to suit the access pattern.
+// With AccessRandom at most one buffer is read ahead, so less data is discarded
+// when seeking, and data is handed over after each read from the input returning
+// data, like WithImmediateForward, so reads after a seek return as soon as possible.
+// With AccessSequential (the default) all buffers are used.
+// Data that has already been read ahead is kept.
+// SetAccessMode can be called concurrently with reads.
+func (a *reader) SetAccessMode(mode AccessMode) error {
+	if mode != AccessSequential && mode != AccessRandom {
+		return fmt.Errorf("unknown access mode %d", mode)
 	}
-	if a.closer != nil {
-		// Only call once
-		c := a.closer
-		a.closer = nil
-		return c.Close()
+	if AccessMode(atomic.SwapInt32(&a.cfg.mode, int32(mode))) != mode {
+		a.mu.Lock()
+		a.stats.ModeSwitches++
+		a.mu.Unlock()
+		a.signalWake()
 	}
-	a.err = errors.New("readahead: read after Close")
 	return nil
 }
 
-// Internal buffer representing a single read.
-// If an error is present, it must be returned
-// once all buffer content has been served.
-type buffer struct {
-	buf    []byte
-	err    error
-	offset int
-	size   int
+// AccessMode returns the access mode set with SetAccessMode.
+func (a *reader) AccessMode() AccessMode {
+	return AccessMode(atomic.LoadInt32(&a.cfg.mode))
 }
 
-func newBuffer(buf []byte) *buffer {
-	return &buffer{buf: buf, err: nil, size: len(buf)}
+// signalWake wakes the async reader if it is waiting in throttle.
+func (a *reader) signalWake() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
 }
 
-// isEmpty returns true is offset is at end of
-// buffer, or if the buffer is nil
-func (b *buffer) isEmpty() bool {
-	if b == nil {
+// send hands a filled buffer to the consumer.
+// If the ready queue is full, the consumer is notified and send
+// waits for space or for exit to be signalled.
+// If exit is signalled the buffer is kept in held and false is returned.
+func (a *reader) send(b *buffer) bool {
+	// Let the consumer inspect the buffer before receiving it.
+	a.mu.Lock()
+	a.queued = append(a.queued, b)
+	a.mu.Unlock()
+	select {
+	case a.ready <- b:
 		return true
+	default:
 	}
-	if len(b.buf)-b.offset <= 0 {
+	select {
+	case a.notify <- struct{}{}:
+	default:
+	}
+	a.enterState(StateConsumerBound)
+	defer a.leaveState(StateConsumerBound)
+	select {
+	case a.ready <- b:
 		return true
+	case <-a.exit:
+		a.held = b
+		return false
 	}
-	return false
 }
 
-// read into start of the buffer from the supplied reader,
-// resets the offset and updates the size of the buffer.
-// Any error encountered during the read is returned.
-func (b *buffer) read(rd io.Reader) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = fmt.Errorf("panic reading: %v", r)
-			b.err = err
-		}
-	}()
+// enterState changes the backpressure state to s,
+// and calls the callback if the state changed.
+func (a *reader) enterState(s State) {
+	if a.onState == nil {
+		return
+	}
+	if State(atomic.SwapInt32(&a.state, int32(s))) != s {
+		a.onState(s)
+	}
+}
 
-	var n int
-	buf := b.buf[0:b.size]
-	for n < b.size {
-		n2, err := rd.Read(buf)
-		n += n2
-		if err != nil {
-			b.err = err
-			break
-		}
+// leaveState changes the backpressure state from s to StateBalanced,
+// and calls the callback if the state was s.
+func (a *reader) leaveState(s State) {
+	if a.onState == nil {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&a.state, int32(s), int32(StateBalanced)) {
+		a.onState(StateBalanced)
+	}
+}
+
+// startLazy will start the async reader if it hasn't been started yet.
+// The first buffer is filled by the caller, see runFirst.
+// It also starts the total timeout on the first read.
+func (a *reader) startLazy() {
+	a.launchLazy(false)
+}
+
+// startLazyContext is like startLazy, but if ctx can be cancelled
+// the first buffer is filled by the async reader, so waiting for it can be cancelled.
+func (a *reader) startLazyContext(ctx context.Context) {
+	a.launchLazy(ctx.Done() != nil)
+}
+
+// launchLazy starts the async reader if it hasn't been started yet.
+// If async is false the first buffer is filled by the caller,
+// unless the total timeout is used, since the read cannot be interrupted.
+func (a *reader) launchLazy(async bool) {
+	if a.totalTimeout > 0 && a.expireTimer == nil {
+		expired := a.expired
+		a.expireTimer = time.AfterFunc(a.totalTimeout, func() {
+			close(expired)
+		})
+	}
+	if a.launch != nil {
+		launch := a.launch
+		a.launch = nil
+		a.lazyStart = false
+		launch(async || a.totalTimeout > 0)
+	}
+}
+
+// stop will make sure the async reader has exited.
+func (a *reader) stop() {
+	if a.launch != nil {
+		// Never started, act as if it has exited.
+		a.launch = nil
+		close(a.ready)
+		close(a.exited)
+		return
+	}
+	select {
+	case <-a.exited:
+	case a.exit <- struct{}{}:
+		<-a.exited
+	}
+}
+
+// restart the async reader from the current position of the input,
+// discarding any data that has been read ahead.
+// pos is the new position of the consumer.
+// The hash set with WithHash is reset, since data is no longer contiguous.
+func (a *reader) restart(pos int64) {
+	a.stop()
+	if a.zeroOnReuse {
+		a.zeroBuffers()
+	}
+	a.initBuffers(a.in, a.bufs, a.buffers, a.size)
+	atomic.StoreInt64(&a.offset, pos)
+	a.ResetHash()
+}
+
+// recycle hands a consumed buffer back to the async reader,
+// unless it has been retired by Resize.
+func (a *reader) recycle(b *buffer) {
+	defer a.signalWake()
+	if a.zeroOnReuse {
+		zero(b.buf[:cap(b.buf)])
+	}
+	if b.retired {
+		a.releaseBuf(b.buf[:b.size])
+		return
+	}
+	// reuse has room for all buffers, and the consumer holds b,
+	// so this never blocks.
+	a.reuse <- b
+}
+
+// fill will check if the current buffer is empty and fill it if it is.
+// If an error was returned at the end of the current buffer it is returned.
+func (a *reader) fill() (err error) {
+	return a.fillContext(context.Background())
+}
+
+// fillContext is like fill, but will return the context error
+// if ctx is done while waiting for data.
+func (a *reader) fillContext(ctx context.Context) (err error) {
+	if a.cur.isEmpty() {
+		if a.cur != nil {
+			a.recycle(a.cur)
+			a.cur = nil
+		}
+		if len(a.pending) > 0 {
+			a.cur = a.pending[0]
+			a.pending = a.pending[1:]
+			return nil
+		}
+		if len(a.ready) == 0 {
+			a.enterState(StateProducerBound)
+			defer a.leaveState(StateProducerBound)
+		}
+		select {
+		case b, ok := <-a.ready:
+			if !ok {
+				if err := a.timedOut(); err != nil {
+					return err
+				}
+				if a.err == nil {
+					a.err = ErrClosed
+				}
+				return a.err
+			}
+			a.received()
+			a.cur = b
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-a.expired:
+			return a.timedOut()
+		case <-a.closing:
+			return ErrClosed
+		}
+	}
+	return nil
+}
+
+// Resize changes the number of buffers and the size of each buffer
+// without losing the current read position.
+// Data that has already been read ahead is kept and returned as usual.
+// Buffers that are not in use are reused if their size matches,
+// and buffers that are no longer needed are released as they are consumed.
+// Resize cannot be called concurrently with other methods.
+func (a *reader) Resize(buffers, size int) error {
+	if size <= 0 {
+		return fmt.Errorf("buffer size too small")
+	}
+	if buffers <= 0 {
+		return fmt.Errorf("number of buffers too small")
+	}
+	if a.closed {
+		return errors.New("readahead: Resize after Close")
+	}
+	if a.err != nil {
+		// No more data will be read.
+		return nil
+	}
+	a.stop()
+
+	// Keep data that has been read ahead.
+	a.collect()
+	var idle []*buffer
+	for len(a.reuse) > 0 {
+		idle = append(idle, <-a.reuse)
+	}
+	inUse := a.pending
+	if a.cur != nil {
+		inUse = append([]*buffer{a.cur}, inUse...)
+	}
+
+	// Keep buffers of the same size, idle ones first.
+	bufs := make([][]byte, 0, buffers)
+	var keep []*buffer
+	for _, b := range idle {
+		if b.size == size && len(bufs) < buffers {
+			bufs = append(bufs, b.buf[:b.size])
+			keep = append(keep, b)
+			continue
+		}
+		a.releaseBuf(b.buf[:b.size])
+	}
+	for _, b := range inUse {
+		if !b.retired && b.size == size && len(bufs) < buffers {
+			bufs = append(bufs, b.buf[:b.size])
+			continue
+		}
+		b.retired = true
+	}
+	if n := buffers - len(bufs); n > 0 {
+		x := make([]byte, n*size)
+		for i := 0; i < n; i++ {
+			buf := x[i*size : (i+1)*size : (i+1)*size]
+			bufs = append(bufs, buf)
+			keep = append(keep, newBuffer(buf))
+		}
+	}
+	a.buffers = buffers
+	a.size = size
+	a.bufs = bufs
+	a.start(keep, a.sourceError())
+	return nil
+}
+
+// ResetSize resets the reader to read from rd with the given number
+// of buffers and size, keeping the options it was created with.
+// Existing buffers with a capacity of at least size are reused,
+// and only missing buffers are allocated, so keeping or reducing the size
+// and number of buffers will not allocate buffers.
+// Buffers dropped by Resize are not reused.
+// With WithLazyBuffers existing buffers are also kept, and missing buffers
+// are allocated once the first buffer has been filled.
+// Data that has been read ahead from the previous input is discarded,
+// and the previous input is not closed.
+// Statistics, the offset and the hash set with WithHash are reset.
+//
+// ResetSize can be called after Close, which allows readers to be pooled.
+// Whether the reader supports seeking is decided when it is created.
+func (a *reader) ResetSize(rd io.Reader, buffers, size int) error {
+	if size <= 0 {
+		return fmt.Errorf("buffer size too small")
+	}
+	if buffers <= 0 {
+		return fmt.Errorf("number of buffers too small")
+	}
+	if rd == nil {
+		return fmt.Errorf("nil input reader supplied")
+	}
+	if a.spillMem > 0 {
+		buffers = a.spillMem
+	}
+	a.stop()
+	if s, ok := a.in.(*spillReader); ok {
+		s.Close()
+	}
+	if a.zeroOnReuse {
+		a.zeroBuffers()
+	}
+
+	// Keep buffers that are big enough.
+	bufs := a.bufs[:0]
+	for _, buf := range a.bufs {
+		if cap(buf) >= size && len(bufs) < buffers {
+			bufs = append(bufs, buf[:size])
+			continue
+		}
+		a.releaseBuf(buf)
+	}
+	n := buffers
+	if a.lazy {
+		// Allocate the rest when needed.
+		n = 1
+	}
+	if missing := n - len(bufs); missing > 0 {
+		x := make([]byte, missing*size)
+		for i := 0; i < missing; i++ {
+			bufs = append(bufs, x[i*size:(i+1)*size:(i+1)*size])
+		}
+	}
+
+	if a.expireTimer != nil {
+		a.expireTimer.Stop()
+		a.expireTimer = nil
+		a.expired = make(chan struct{})
+	}
+	a.closed = false
+	a.closeOnce = sync.Once{}
+	a.closer = nil
+	a.sizeKnown = false
+	a.mu.Lock()
+	a.stats = Stats{}
+	a.begin = time.Time{}
+	a.gotFirst = false
+	a.mu.Unlock()
+	a.initBuffers(rd, bufs, buffers, size)
+	atomic.StoreInt64(&a.offset, 0)
+	a.ResetHash()
+	return nil
+}
+
+// sourceError returns the error returned by the input, if any.
+func (a *reader) sourceError() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.srcErr
+}
+
+// setErr sets the terminal error of the reader and returns it.
+// Errors other than io.EOF are returned as a ReadError at the current offset.
+func (a *reader) setErr(err error) error {
+	if err != nil && err != io.EOF {
+		err = &ReadError{Err: err, Offset: atomic.LoadInt64(&a.offset)}
+	}
+	a.err = err
+	return err
+}
+
+// peekErr returns an error returned by the input after n bytes
+// that have not been read yet, as it will be returned by Read.
+func (a *reader) peekErr(err error, n int) error {
+	if err != nil && err != io.EOF {
+		err = &ReadError{Err: err, Offset: atomic.LoadInt64(&a.offset) + int64(n)}
+	}
+	return err
+}
+
+// timedOut returns ErrTotalTimeout if the total timeout has elapsed.
+func (a *reader) timedOut() error {
+	select {
+	case <-a.expired:
+		a.err = ErrTotalTimeout
+		return a.err
+	default:
+		return nil
+	}
+}
+
+// failed returns the input error if fail fast is enabled
+// and the input has returned an error.
+// If the total timeout has elapsed, ErrTotalTimeout is returned.
+func (a *reader) failed() error {
+	if err := a.timedOut(); err != nil {
+		return err
+	}
+	if a.failFast {
+		if err := a.sourceError(); err != nil && err != io.EOF {
+			return a.setErr(err)
+		}
+	}
+	return nil
+}
+
+// WaitSaturated waits until the input cannot be read further ahead.
+// This happens when all buffers have been filled,
+// the queue of filled buffers is full (see WithQueueDepth),
+// or the input has returned EOF or an error.
+// If the input returned an error other than EOF it is returned.
+// If ctx is done before that, the context error is returned.
+func (a *reader) WaitSaturated(ctx context.Context) error {
+	a.startLazyContext(ctx)
+	for {
+		if err := a.sourceError(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		held := len(a.ready) + len(a.pending)
+		if a.cur != nil {
+			held++
+		}
+		if held >= a.buffers || len(a.ready) >= cap(a.ready) {
+			return nil
+		}
+		select {
+		case <-a.notify:
+		case <-a.exited:
+			if a.sourceError() == nil {
+				return ErrClosed
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Prefetch reads the input until it returns EOF or an error,
+// and returns the error, or nil for EOF.
+// The data is kept in the buffers and can be read as usual afterwards.
+// Prefetch is intended for inputs that fit in the buffers.
+// If the input is larger, Prefetch will block once all buffers are
+// filled until the data is consumed or ctx is done,
+// in which case the context error is returned.
+func (a *reader) Prefetch(ctx context.Context) error {
+	a.startLazyContext(ctx)
+	for {
+		if err := a.sourceError(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		select {
+		case <-a.notify:
+		case <-a.exited:
+			if a.sourceError() == nil {
+				return ErrClosed
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Read will return the next available data.
+// Unless WithRecordSize is used, a single Read never returns data from
+// more than one buffer, so it returns at most the remaining data of the
+// current buffer.
+func (a *reader) Read(p []byte) (n int, err error) {
+	if a.useCheck {
+		a.enterUse()
+		defer a.leaveUse()
+	}
+	a.readMu.Lock()
+	defer a.readMu.Unlock()
+	if a.eofErr != nil {
+		defer func() {
+			if err == io.EOF {
+				err = a.eofErr
+			}
+		}()
+	}
+	a.startLazy()
+	if a.readHist {
+		defer func() {
+			a.recordRead(len(p), n)
+		}()
+	}
+	if a.err != nil {
+		return 0, a.err
+	}
+	if err := a.failed(); err != nil {
+		return 0, err
+	}
+	if a.recordSize > 0 {
+		return a.readRecords(p)
+	}
+	// Swap buffer and maybe return error
+	err = a.fill()
+	if err != nil {
+		return 0, err
+	}
+
+	// Copy what we can
+	n = copy(p, a.cur.buffer())
+	a.consume(n)
+	defer func() {
+		// Close waits for us, so return the copied data with the error.
+		select {
+		case <-a.closing:
+			err = ErrClosed
+		default:
+		}
+	}()
+
+	if a.cur.isEmpty() {
+		// Return current, so a fetch can start.
+		if a.cur != nil {
+			// If at end of buffer, return any error, if present
+			a.setErr(a.cur.err)
+			if a.err == nil && a.eofCoupling && n > 0 && a.atEOF() {
+				a.err = io.EOF
+			}
+			a.recycle(a.cur)
+			a.cur = nil
+		}
+		return n, a.err
+	}
+	return n, nil
+}
+
+// atEOF returns whether it is known without waiting,
+// that the input ends after the current buffer.
+func (a *reader) atEOF() bool {
+	if a.cur.last {
+		return true
+	}
+	next := a.next()
+	if next == nil {
+		return false
+	}
+	return next.isEmpty() && next.err == io.EOF
+}
+
+// readRecords will read whole records into p.
+// Only a trailing partial record is returned with an error.
+func (a *reader) readRecords(p []byte) (n int, err error) {
+	if len(p) < a.recordSize {
+		return 0, io.ErrShortBuffer
+	}
+	p = p[:len(p)-len(p)%a.recordSize]
+	for n < len(p) {
+		if n > 0 && n%a.recordSize == 0 && a.cur.isEmpty() {
+			// Don't wait for more data on a record boundary.
+			break
+		}
+		err = a.fill()
+		if err != nil {
+			return n, err
+		}
+		n2 := copy(p[n:], a.cur.buffer())
+		a.consume(n2)
+		n += n2
+		if a.cur.isEmpty() {
+			a.setErr(a.cur.err)
+			a.recycle(a.cur)
+			a.cur = nil
+			if a.err != nil {
+				return n, a.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// ReadVec fills the supplied slices in order.
+// Unlike Read, it will wait for more data until all slices have been filled,
+// or an error occurs.
+// It returns the total number of bytes copied and any error encountered.
+// At the end of the input io.EOF is returned, or the error set with WithEOFError.
+func (a *reader) ReadVec(bufs ...[]byte) (n int, err error) {
+	n, err = a.readVec(bufs...)
+	return n, a.eofError(err)
+}
+
+// readVec fills the supplied slices in order.
+func (a *reader) readVec(bufs ...[]byte) (n int, err error) {
+	a.startLazy()
+	if a.err != nil {
+		return 0, a.err
+	}
+	if err := a.failed(); err != nil {
+		return 0, err
+	}
+	for _, p := range bufs {
+		for len(p) > 0 {
+			err = a.fill()
+			if err != nil {
+				return n, err
+			}
+			n2 := copy(p, a.cur.buffer())
+			a.consume(n2)
+			n += n2
+			p = p[n2:]
+			if a.cur.isEmpty() {
+				a.setErr(a.cur.err)
+				a.recycle(a.cur)
+				a.cur = nil
+				if a.err != nil {
+					return n, a.err
+				}
+			}
+		}
+	}
+	return n, nil
+}
+
+// ReadAtLeast reads into p until it has read at least min bytes,
+// like io.ReadAtLeast.
+// Data that is available without waiting is also read, up to len(p).
+// It returns the number of bytes copied and an error if fewer bytes were read.
+// The error is io.EOF, or the error set with WithEOFError, only if no bytes were read.
+// If the input ends after reading some but not min bytes,
+// io.ErrUnexpectedEOF is returned.
+// If min is greater than the length of p, io.ErrShortBuffer is returned.
+func (a *reader) ReadAtLeast(p []byte, min int) (n int, err error) {
+	if len(p) < min {
+		return 0, io.ErrShortBuffer
+	}
+	n, err = a.readAtLeast(p, min)
+	if n >= min {
+		err = nil
+	} else if n > 0 && err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, a.eofError(err)
+}
+
+// readAtLeast reads until min bytes have been read,
+// and then what is available without waiting.
+func (a *reader) readAtLeast(p []byte, min int) (n int, err error) {
+	a.startLazy()
+	if a.err != nil {
+		return 0, a.err
+	}
+	if err := a.failed(); err != nil {
+		return 0, err
+	}
+	for n < len(p) {
+		if n >= min && a.cur.isEmpty() {
+			break
+		}
+		err = a.fill()
+		if err != nil {
+			return n, err
+		}
+		n2 := copy(p[n:], a.cur.buffer())
+		a.consume(n2)
+		n += n2
+		if a.cur.isEmpty() {
+			a.setErr(a.cur.err)
+			a.recycle(a.cur)
+			a.cur = nil
+			if a.err != nil {
+				return n, a.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// ReadN reads and returns the next n bytes in a newly allocated slice.
+// If the input ends before n bytes have been read,
+// the bytes read are returned with io.ErrUnexpectedEOF,
+// or io.EOF, or the error set with WithEOFError, if no bytes were read.
+func (a *reader) ReadN(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, errors.New("readahead: negative count")
+	}
+	p := make([]byte, n)
+	got, err := a.readVec(p)
+	if err == io.EOF {
+		switch {
+		case got == n:
+			err = nil
+		case got > 0:
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return p[:got], a.eofError(err)
+}
+
+// ReadUntil reads until the first occurrence of delim and returns
+// the data up to and including the delimiter in a newly allocated slice.
+// Delimiters spanning buffers are found, and the data is combined.
+// If the input ends before the delimiter is found,
+// the remaining data is returned with io.EOF,
+// or the error set with WithEOFError.
+func (a *reader) ReadUntil(delim byte) ([]byte, error) {
+	return a.ReadUntilLimit(delim, 0)
+}
+
+// ReadUntilLimit is like ReadUntil, but reads at most max bytes.
+// If the delimiter isn't found within max bytes, the max bytes
+// are returned with ErrTokenTooLong, and the following reads continue after them.
+// If max <= 0 there is no limit.
+func (a *reader) ReadUntilLimit(delim byte, max int) (token []byte, err error) {
+	token, err = a.readUntil(delim, max)
+	return token, a.eofError(err)
+}
+
+// readUntil reads until the first occurrence of delim, or max bytes if max > 0.
+func (a *reader) readUntil(delim byte, max int) (token []byte, err error) {
+	a.startLazy()
+	for {
+		if a.err != nil {
+			return token, a.err
+		}
+		if err := a.failed(); err != nil {
+			return token, err
+		}
+		if err := a.fill(); err != nil {
+			return token, err
+		}
+		data := a.cur.buffer()
+		n := bytes.IndexByte(data, delim) + 1
+		found := n > 0
+		if !found {
+			n = len(data)
+		}
+		tooLong := max > 0 && len(token)+n > max
+		if tooLong {
+			n = max - len(token)
+		}
+		token = append(token, data[:n]...)
+		a.consume(n)
+		if a.cur.isEmpty() {
+			a.setErr(a.cur.err)
+			a.recycle(a.cur)
+			a.cur = nil
+		}
+		switch {
+		case tooLong:
+			return token, ErrTokenTooLong
+		case found:
+			return token, nil
+		}
+	}
+}
+
+// received must be called when a buffer has been received from ready.
+func (a *reader) received() {
+	a.mu.Lock()
+	a.queued[0] = nil
+	a.queued = a.queued[1:]
+	a.mu.Unlock()
+}
+
+// tryReceive moves the next buffer from ready to pending without blocking.
+// It returns false if no buffer is ready.
+func (a *reader) tryReceive() bool {
+	select {
+	case b, ok := <-a.ready:
+		if !ok {
+			return false
+		}
+		a.received()
+		a.pending = append(a.pending, b)
+		return true
+	default:
+		return false
+	}
+}
+
+// next returns the buffer following the current one,
+// or nil if it has not been handed over yet.
+// The buffer is left in ready.
+func (a *reader) next() *buffer {
+	if len(a.pending) > 0 {
+		return a.pending[0]
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.queued) > 0 {
+		return a.queued[0]
+	}
+	return nil
+}
+
+// Buffered returns the number of bytes that have been read ahead
+// and can be read without waiting for the input.
+// It does not block, and can be called concurrently with reads.
+func (a *reader) Buffered() int {
+	n := atomic.LoadInt64(&a.filled) - atomic.LoadInt64(&a.used)
+	if n < 0 {
+		return 0
+	}
+	return int(n)
+}
+
+// NextSize returns the size of the data that the next call to ReadBuffer
+// will return, without waiting for the input.
+// If no data is available at the moment, 0 and false is returned.
+func (a *reader) NextSize() (int, bool) {
+	if a.err != nil {
+		return 0, false
+	}
+	if !a.cur.isEmpty() {
+		return len(a.cur.buffer()), true
+	}
+	for _, b := range a.pending {
+		if !b.isEmpty() {
+			return len(b.buffer()), true
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, b := range a.queued {
+		if !b.isEmpty() {
+			return len(b.buffer()), true
+		}
+	}
+	return 0, false
+}
+
+// Free returns the number of bytes of buffer capacity
+// that isn't used by data returned by Buffered.
+// This is how much more of the input can be read ahead,
+// before reading waits for data to be consumed.
+// It does not block, and can be called concurrently with reads.
+func (a *reader) Free() int {
+	free := a.buffers*a.size - a.Buffered()
+	if free < 0 {
+		// Buffers dropped by Resize may still hold data.
+		return 0
+	}
+	return free
+}
+
+// Idle returns the number of empty buffers waiting to be filled
+// by the async reader.
+// If it is mostly high the input is the bottleneck, and if it is
+// mostly low the consumer is.
+// Buffers that have not been allocated yet with WithLazyBuffers are not counted.
+// It does not block.
+func (a *reader) Idle() int {
+	return len(a.reuse)
+}
+
+// PeekAvailable returns a copy of all data that has been read ahead,
+// without waiting for more data.
+// The data is not consumed, so it will also be returned by the following reads.
+// If nothing is available an empty slice is returned.
+func (a *reader) PeekAvailable() []byte {
+	a.launchLazy(true) // Don't wait for the first buffer.
+	if a.err != nil {
+		return []byte{}
+	}
+	dst := make([]byte, 0, a.Buffered())
+	if a.cur != nil {
+		dst = append(dst, a.cur.buffer()...)
+	}
+	for _, b := range a.pending {
+		dst = append(dst, b.buffer()...)
+	}
+	a.mu.Lock()
+	for _, b := range a.queued {
+		dst = append(dst, b.buffer()...)
+	}
+	a.mu.Unlock()
+	return dst
+}
+
+// Peek returns the next n bytes without advancing the reader.
+// If the input ends before n bytes are available, the remaining bytes
+// are returned along with the error, which is io.EOF at the end of the input,
+// or the error set with WithEOFError.
+// Other errors from the input are returned as a *ReadError, like Read.
+// Peek can look as far ahead as the buffers allow.
+// If n is larger than that, the available bytes are returned with bufio.ErrBufferFull.
+// The returned slice is only valid until the next call to the reader,
+// and should not be modified.
+func (a *reader) Peek(n int) ([]byte, error) {
+	b, err := a.peek(n)
+	return b, a.eofError(err)
+}
+
+// peek returns the next n bytes without advancing the reader.
+func (a *reader) peek(n int) ([]byte, error) {
+	a.startLazy()
+	if n < 0 {
+		return nil, bufio.ErrNegativeCount
+	}
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err := a.failed(); err != nil {
+		return nil, err
+	}
+	if err := a.fill(); err != nil {
+		return nil, err
+	}
+	if buf := a.cur.buffer(); len(buf) >= n {
+		return buf[:n], nil
+	} else if a.cur.err != nil {
+		if len(buf) == 0 {
+			// Keep the error, since the buffer is handed back on the next fill.
+			return buf, a.setErr(a.cur.err)
+		}
+		return buf, a.peekErr(a.cur.err, len(buf))
+	}
+
+	// Read ahead past the limit set with SetMaxLookahead if needed.
+	atomic.StoreInt64(&a.peekMin, int64(n))
+	a.signalWake()
+	defer atomic.StoreInt64(&a.peekMin, 0)
+
+	// Collect the following buffers until we have enough.
+	avail := len(a.cur.buffer())
+	held := 1
+	var err error
+	for i := 0; avail < n && err == nil; i++ {
+		if i == len(a.pending) {
+			if held >= a.buffers {
+				// The async reader has no more buffers to fill.
+				err = bufio.ErrBufferFull
+				break
+			}
+			b, ok := <-a.ready
+			if !ok {
+				err = ErrClosed
+				break
+			}
+			a.received()
+			a.pending = append(a.pending, b)
+		}
+		b := a.pending[i]
+		if !b.retired {
+			held++
+		}
+		avail += len(b.buffer())
+		err = a.peekErr(b.err, avail)
+	}
+	if avail > n {
+		avail = n
+	}
+	if cap(a.peekBuf) < avail {
+		a.peekBuf = make([]byte, 0, avail)
+	}
+	dst := append(a.peekBuf[:0], a.cur.buffer()...)
+	for _, b := range a.pending {
+		if len(dst) >= avail {
+			break
+		}
+		dst = append(dst, b.buffer()...)
+	}
+	dst = dst[:avail]
+	a.peekBuf = dst
+	if avail == n {
+		err = nil
+	}
+	return dst, err
+}
+
+// ReadBuffer returns the remaining data of the current buffer.
+// Each call will return data from a single buffer,
+// so calls map to how the input was read into buffers.
+// The returned slice is only valid until the next call to the reader,
+// and should not be modified.
+// Errors are returned like Read.
+func (a *reader) ReadBuffer() ([]byte, error) {
+	buf, err := a.readBuffer()
+	return buf, a.eofError(err)
+}
+
+// readBuffer returns the remaining data of the current buffer.
+func (a *reader) readBuffer() ([]byte, error) {
+	a.startLazy()
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err := a.failed(); err != nil {
+		return nil, err
+	}
+	err := a.fill()
+	if err != nil {
+		return nil, err
+	}
+	// The buffer is handed back on the next fill.
+	buf := a.cur.buffer()
+	a.consume(len(buf))
+	return buf, a.setErr(a.cur.err)
+}
+
+func (a *seekable) Seek(offset int64, whence int) (res int64, err error) {
+	if a.useCheck {
+		a.enterUse()
+		defer a.leaveUse()
+	}
+	//The input may have been replaced by ResetSize with one that cannot seek.
+	seeker, ok := a.in.(io.Seeker)
+	if !ok {
+		return 0, errors.New("readahead: input does not support seeking")
+	}
+	//Make sure the async routine is closed
+	a.stop()
+	a.collect()
+	a.mu.Lock()
+	a.stats.Seeks++
+	a.mu.Unlock()
+	if whence == io.SeekEnd && a.sizeCache {
+		// Use the cached size if it is recent enough.
+		if a.sizeKnown && (a.sizeRefresh == 0 || time.Since(a.sizeTime) < a.sizeRefresh) {
+			offset += a.sizeEnd
+			whence = io.SeekStart
+		}
+	}
+	ahead := a.readAhead()
+	if whence != io.SeekEnd && a.err == nil {
+		//Keep the data that has been read ahead if the position doesn't change.
+		if res, ok := a.seekBuffered(seeker, offset, whence, ahead); ok {
+			return res, nil
+		}
+	}
+	if whence == io.SeekCurrent {
+		//If need to seek based on current position, take into consideration the bytes we read but the consumer
+		//doesn't know about.
+		//The end of the input is always queried from the Seeker, so nothing is needed for io.SeekEnd.
+		offset -= ahead
+	}
+	//Seek the actual Seeker
+	if res, err = seeker.Seek(offset, whence); err == nil {
+		//If the seek was successful, reinitalize ourselves (with the new position).
+		a.mu.Lock()
+		a.stats.SeekBytesDiscarded += ahead
+		a.mu.Unlock()
+		a.restart(res)
+		if whence == io.SeekEnd && a.sizeCache {
+			a.sizeEnd = res - offset
+			a.sizeTime = time.Now()
+			a.sizeKnown = true
+		}
+	} else {
+		// The position is unchanged, continue reading ahead.
+		a.resume()
+	}
+	return
+}
+
+// WriteRange writes length bytes starting at offset off to w,
+// for example to serve a range request.
+// The reader is left positioned after the written data, at off+length
+// if the whole range was written.
+// If the input ends before the range is written, including when off is beyond
+// the end of the input, the number of bytes written and io.EOF is returned.
+func (a *seekable) WriteRange(w io.Writer, off, length int64) (int64, error) {
+	if off < 0 {
+		return 0, errors.New("readahead: negative offset")
+	}
+	if length < 0 {
+		return 0, errors.New("readahead: negative byte count")
+	}
+	if _, err := a.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return a.WriteToN(w, length)
+}
+
+// readAhead returns the number of bytes that have been read from the input,
+// but not returned to the consumer.
+// The async reader must be stopped.
+func (a *reader) readAhead() (n int64) {
+	if a.cur != nil {
+		n += int64(len(a.cur.buffer()))
+	}
+	for _, b := range a.pending {
+		n += int64(len(b.buffer()))
+	}
+	return n
+}
+
+// collect moves buffers handed over by the async reader to pending.
+// The async reader must be stopped.
+func (a *reader) collect() {
+	for b := range a.ready {
+		a.pending = append(a.pending, b)
+	}
+	if a.held != nil {
+		a.pending = append(a.pending, a.held)
+		a.held = nil
+	}
+	a.mu.Lock()
+	a.queued = nil
+	a.mu.Unlock()
+}
+
+// seekBuffered handles seeks to the current position, such as position queries,
+// without seeking the input or discarding the data that has been read ahead.
+// ahead is the number of bytes read ahead.
+// The hash set with WithHash is reset, like for other seeks.
+// The async reader must be stopped and buffers collected.
+func (a *reader) seekBuffered(seeker io.Seeker, offset int64, whence int, ahead int64) (int64, bool) {
+	end, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false
+	}
+	pos := end - ahead
+	target := offset
+	if whence == io.SeekCurrent {
+		target += pos
+	}
+	if target != pos {
+		return 0, false
+	}
+	a.resume()
+	atomic.StoreInt64(&a.offset, pos)
+	a.ResetHash()
+	a.mu.Lock()
+	a.stats.BufferedSeeks++
+	a.mu.Unlock()
+	return pos, true
+}
+
+// ClearError clears an error returned by the input, and continues reading
+// from the input at its current position.
+// Data that was read before the error is kept, and data returned by the
+// input with the error is not lost.
+// It can be used to recover from transient errors that are not retried
+// automatically, when the input can continue after returning an error.
+// ClearError cannot be called concurrently with other methods.
+//
+// Only an error that has been returned by a read is cleared.
+// If the input has returned an error that has not been returned by a read yet,
+// the error is returned without clearing it, and ClearError can be called
+// once the read has returned it.
+// If there is no input error nil is returned.
+// After Close ErrClosed is returned, at the end of the input io.EOF is returned,
+// and other errors, like ErrTotalTimeout, are returned without clearing them.
+func (a *reader) ClearError() error {
+	if a.closed {
+		return ErrClosed
+	}
+	if a.err == nil {
+		if err := a.sourceError(); err != io.EOF {
+			return err
+		}
+		return nil
+	}
+	var re *ReadError
+	if !errors.As(a.err, &re) {
+		return a.err
+	}
+	a.stop()
+	a.collect()
+	for _, b := range append(a.pending, a.cur) {
+		if b != nil && b.err != io.EOF {
+			b.err = nil
+		}
+	}
+	a.mu.Lock()
+	a.srcErr = nil
+	a.mu.Unlock()
+	a.err = nil
+	a.resume()
+	return nil
+}
+
+// resume starts the async reader after stop,
+// keeping the data that has been read ahead.
+// Buffers must have been collected.
+func (a *reader) resume() {
+	var idle []*buffer
+	for len(a.reuse) > 0 {
+		idle = append(idle, <-a.reuse)
+	}
+	a.start(idle, a.sourceError())
+}
+
+// Clone returns a new reader reading ahead from the current position of the consumer.
+// The returned reader has its own buffers and async reader, with the same
+// number and size of buffers, but without the options of this reader.
+// It can be used and closed independently and concurrently with this reader,
+// but closing this reader may close the input used by both.
+// The input must support both io.ReaderAt and io.Seeker, like *os.File,
+// or the reader must have been created by NewReaderAt.
+func (a *reader) Clone() (ReadSeekCloser, error) {
+	if a.closed {
+		return nil, errors.New("readahead: Clone after Close")
+	}
+	seeker, ok := a.in.(io.Seeker)
+	if !ok {
+		return nil, errors.New("readahead: input does not support seeking")
+	}
+	var ra io.ReaderAt
+	switch in := a.in.(type) {
+	case *readerAt:
+		ra = in.rd
+	case io.ReaderAt:
+		ra = in
+	default:
+		return nil, errors.New("readahead: input does not support io.ReaderAt")
+	}
+	a.stop()
+	a.collect()
+	end, err := seeker.Seek(0, io.SeekCurrent)
+	pos := end - a.readAhead()
+	a.resume()
+	if err != nil {
+		return nil, err
+	}
+	rd, err := NewReaderSize(&readerAt{rd: ra, off: pos}, a.buffers, a.size)
+	if err != nil {
+		return nil, err
+	}
+	return rd.(ReadSeekCloser), nil
+}
+
+// Name returns the name set with WithName.
+func (a *reader) Name() string {
+	return a.name
+}
+
+// Offset returns the number of bytes returned to the consumer so far.
+// After a Seek it returns the position seeked to.
+// Offset can be called concurrently with other methods.
+func (a *reader) Offset() int64 {
+	return atomic.LoadInt64(&a.offset)
+}
+
+// Remaining returns the number of bytes left before the end of the input,
+// for inputs with a known limit, such as an *io.LimitedReader.
+// Bytes returned to the consumer are not counted, but bytes read ahead are.
+// If the limit is unknown -1 is returned.
+func (a *reader) Remaining() int64 {
+	if a.limit < 0 {
+		return -1
+	}
+	n := a.limit - (atomic.LoadInt64(&a.used) - a.limitBase)
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// WriteTo writes data to w until there's no more data to write or when an error occurs.
+// The return value n is the number of bytes written.
+// Any error encountered during the write is also returned.
+func (a *reader) WriteTo(w io.Writer) (n int64, err error) {
+	return a.WriteToFunc(w, nil)
+}
+
+// WriteToFunc writes data to w like WriteTo.
+// If progress is non-nil it is called after each successful write
+// with the total number of bytes written so far.
+// If progress panics the reader is closed and the panic is returned as an error,
+// unless WithPanicPropagation is used.
+func (a *reader) WriteToFunc(w io.Writer, progress func(written int64)) (n int64, err error) {
+	return a.writeTo(context.Background(), w, progress, -1)
+}
+
+// WriteToContext writes data to w like WriteTo.
+// If ctx is done before all data has been written,
+// the number of bytes written so far and the context error is returned.
+// This includes when waiting for data from the input.
+// Data that hasn't been written can still be read afterwards.
+func (a *reader) WriteToContext(ctx context.Context, w io.Writer) (n int64, err error) {
+	return a.writeTo(ctx, w, nil, -1)
+}
+
+// WriteToN writes up to n bytes to w like WriteTo.
+// Data after the first n bytes is not consumed,
+// and can be read or written afterwards.
+// If the input ends before n bytes have been written,
+// the number of bytes written and io.EOF is returned.
+func (a *reader) WriteToN(w io.Writer, n int64) (written int64, err error) {
+	if n < 0 {
+		return 0, errors.New("readahead: negative byte count")
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return a.writeTo(context.Background(), w, nil, n)
+}
+
+// WriteToMulti writes data to all writers in ws until there's no more data
+// to write or when an error occurs.
+// Each buffer is written to all writers before the next is written.
+// The return value n is the number of bytes written to all writers.
+//
+// Writers must accept all data of each write.
+// If a writer returns an error, or writes less than it was given, in which
+// case io.ErrShortWrite is returned, the buffer is not consumed.
+// Writers before the failing one in ws will have received the buffer,
+// and writers after it will not.
+func (a *reader) WriteToMulti(ws ...io.Writer) (n int64, err error) {
+	if a.eofErr != nil {
+		defer func() {
+			if err == io.EOF {
+				err = a.eofErr
+			}
+		}()
+	}
+	a.startLazy()
+	if a.err != nil {
+		return 0, a.err
+	}
+	for {
+		if err = a.failed(); err != nil {
+			return n, err
+		}
+		err = a.fill()
+		if err != nil {
+			return n, err
+		}
+		data := a.cur.buffer()
+		for _, w := range ws {
+			n2, err := w.Write(data)
+			if err == nil && n2 < len(data) {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				return n, err
+			}
+		}
+		a.advance(len(data))
+		n += int64(len(data))
+		if a.cur.err != nil {
+			if a.cur.err == io.EOF {
+				a.err = a.cur.err
+				// nil unless WithEOFError is used.
+				return n, a.eofErr
+			}
+			return n, a.setErr(a.cur.err)
+		}
+	}
+}
+
+// ForEachBuffer reads the input and calls fn with the data of each buffer,
+// until the end of the input, which returns nil, or the error set with WithEOFError.
+// The data is only valid until fn returns, and should not be modified.
+// If fn returns an error, no more data is read and the error is returned.
+// If ctx is done before the end, the context error is returned.
+// Errors from the input are returned like Read.
+// If fn panics the reader is closed and the panic is returned as an error,
+// unless WithPanicPropagation is used.
+func (a *reader) ForEachBuffer(ctx context.Context, fn func(b []byte) error) error {
+	a.startLazyContext(ctx)
+	for {
+		if a.err != nil {
+			if a.err == io.EOF {
+				return a.eofErr
+			}
+			return a.err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := a.failed(); err != nil {
+			return err
+		}
+		if err := a.fillContext(ctx); err != nil {
+			return err
+		}
+		data := a.cur.buffer()
+		a.consume(len(data))
+		if a.cur.err != nil {
+			a.setErr(a.cur.err)
+		}
+		if len(data) > 0 {
+			if err := a.callback(func() error { return fn(data) }); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// callback calls fn, which calls a function supplied by the caller.
+// If it panics the reader is closed and the panic is returned as an error,
+// or continues if WithPanicPropagation is used.
+func (a *reader) callback(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			a.Close()
+			if a.cfg.panics {
+				panic(r)
+			}
+			err = fmt.Errorf("panic in callback: %v", r)
+		}
+	}()
+	return fn()
+}
+
+// writeTo implements the WriteTo variants.
+// If limit >= 0 at most limit bytes are written.
+func (a *reader) writeTo(ctx context.Context, w io.Writer, progress func(written int64), limit int64) (n int64, err error) {
+	if a.useCheck {
+		a.enterUse()
+		defer a.leaveUse()
+	}
+	if a.eofErr != nil {
+		defer func() {
+			if err == io.EOF {
+				err = a.eofErr
+			}
+		}()
+	}
+	a.startLazyContext(ctx)
+	if a.err != nil {
+		return 0, a.err
+	}
+	n = 0
+	backoff := minWriteBackoff
+	var scratch []byte
+	if a.writeCoalesce > 0 {
+		scratch = make([]byte, 0, a.writeCoalesce)
+	}
+	for {
+		if err = ctx.Err(); err != nil {
+			return n, err
+		}
+		if err = a.failed(); err != nil {
+			return n, err
+		}
+		err = a.fillContext(ctx)
+		if err != nil {
+			return n, err
+		}
+		data := a.cur.buffer()
+		if scratch != nil && a.cur.err == nil && len(data) < a.writeCoalesce {
+			data = a.coalesce(scratch)
+		}
+		if limit >= 0 && int64(len(data)) > limit-n {
+			data = data[:limit-n]
+		}
+		n2, err := w.Write(data)
+		a.advance(n2)
+		n += int64(n2)
+		if err != nil {
+			switch {
+			case wouldBlock(err) && a.writeReady != nil:
+				// Wait for the writer to become ready.
+				select {
+				case _, ok := <-a.writeReady:
+					if !ok {
+						return n, err
+					}
+				case <-ctx.Done():
+					return n, ctx.Err()
+				}
+			case wouldBlock(err) || (a.writeRetry != nil && a.writeRetry(err)):
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return n, ctx.Err()
+				}
+				if backoff *= 2; backoff > maxWriteBackoff {
+					backoff = maxWriteBackoff
+				}
+			default:
+				return n, err
+			}
+			if !a.cur.isEmpty() {
+				// Retry the remaining data.
+				continue
+			}
+		} else {
+			backoff = minWriteBackoff
+			if progress != nil {
+				if err := a.callback(func() error { progress(n); return nil }); err != nil {
+					return n, err
+				}
+			}
+		}
+		if a.cur.err != nil && a.cur.isEmpty() {
+			// io.Writer should return nil if we are at EOF.
+			if a.cur.err == io.EOF {
+				a.err = a.cur.err
+				if n < limit || a.eofErr != nil {
+					return n, io.EOF
+				}
+				return n, nil
+			}
+			return n, a.setErr(a.cur.err)
+		}
+		if limit >= 0 && n >= limit {
+			return n, nil
+		}
+	}
+}
+
+// coalesce returns the data of the current buffer followed by the data
+// of buffers that are ready, up to writeCoalesce bytes.
+// If other buffers are added the data is copied to dst.
+// No data is consumed.
+func (a *reader) coalesce(dst []byte) []byte {
+	next := a.next()
+	if next == nil || len(a.cur.buffer())+len(next.buffer()) > a.writeCoalesce {
+		return a.cur.buffer()
+	}
+	dst = append(dst[:0], a.cur.buffer()...)
+	for i := 0; i < len(a.pending) || a.tryReceive(); i++ {
+		b := a.pending[i]
+		if len(dst)+len(b.buffer()) > a.writeCoalesce {
+			break
+		}
+		dst = append(dst, b.buffer()...)
+		if b.err != nil {
+			break
+		}
+	}
+	return dst
+}
+
+// advance consumes n bytes, starting with the current buffer
+// and continuing with pending buffers.
+func (a *reader) advance(n int) {
+	for n > len(a.cur.buffer()) && len(a.pending) > 0 {
+		rem := len(a.cur.buffer())
+		a.consume(rem)
+		n -= rem
+		a.recycle(a.cur)
+		a.cur = a.pending[0]
+		a.pending = a.pending[1:]
+	}
+	a.consume(n)
+}
+
+// consume marks the next n bytes of the current buffer
+// as returned to the consumer.
+func (a *reader) consume(n int) {
+	if a.hash != nil {
+		a.hash.Write(a.cur.buffer()[:n])
+	}
+	a.cur.inc(n)
+	atomic.AddInt64(&a.offset, int64(n))
+	atomic.AddInt64(&a.used, int64(n))
+}
+
+// ResetHash resets the hash set with WithHash to its initial state.
+func (a *reader) ResetHash() {
+	if a.hash != nil {
+		a.hash.Reset()
+	}
+}
+
+// WithRawReader pauses reading ahead and calls fn with the input,
+// so it can be accessed directly, for example to call methods of the input.
+// Reading ahead continues from the position of the input when fn returns.
+//
+// The input is positioned after the data that has been read ahead,
+// which is Buffered bytes ahead of the consumer.
+// This data is kept, and will be returned by the following reads.
+// Data read from the input by fn is not returned by the reader.
+// To access the input at the position of the consumer, use Detach.
+//
+// The error returned by fn is returned.
+// WithRawReader cannot be used with WithSpill.
+func (a *reader) WithRawReader(fn func(in io.Reader) error) error {
+	if a.closed {
+		return errors.New("readahead: WithRawReader after Close")
+	}
+	if _, ok := a.in.(*spillReader); ok {
+		return errors.New("readahead: WithRawReader cannot be used with WithSpill")
+	}
+	a.stop()
+	a.collect()
+	defer a.resume()
+	return fn(a.in)
+}
+
+// As sets target to the input supplied when the reader was created,
+// if it can be assigned to the value pointed to by target, and returns true.
+// This allows access to interfaces and types of the input,
+// like an *os.File or a Stat method.
+// Like errors.As it panics if target is not a non-nil pointer.
+//
+// Reading from the input or changing its position while reading ahead
+// is not safe. Use WithRawReader to pause reading ahead.
+func (a *reader) As(target interface{}) bool {
+	if target == nil {
+		panic("readahead: target cannot be nil")
+	}
+	val := reflect.ValueOf(target)
+	if val.Kind() != reflect.Ptr || val.IsNil() {
+		panic("readahead: target must be a non-nil pointer")
+	}
+	// Find the input inside the wrappers of this package.
+	var in interface{} = a.in
+	for {
+		switch r := in.(type) {
+		case *spillReader:
+			in = r.src
+			continue
+		case *readerAt:
+			in = r.rd
+			continue
+		}
+		break
+	}
+	if in == nil || !reflect.TypeOf(in).AssignableTo(val.Type().Elem()) {
+		return false
+	}
+	val.Elem().Set(reflect.ValueOf(in))
+	return true
+}
+
+// Detach stops reading ahead and returns the input along with
+// the data that has been read ahead, but not returned to the consumer.
+// The input is positioned after the returned data, so the remaining
+// stream can be read with io.MultiReader(bytes.NewReader(leftover), in).
+// If the input returned an error other than io.EOF it is returned.
+//
+// The reader cannot be used after Detach.
+// Close will no longer close the input, but closers added with
+// WithClosers will still be called.
+// Detach cannot be used with WithSpill.
+func (a *reader) Detach() (in io.Reader, leftover []byte, err error) {
+	if a.closed {
+		return nil, nil, errors.New("readahead: Detach after Close")
+	}
+	if _, ok := a.in.(*spillReader); ok {
+		// Spilled data is not part of leftover, and is lost when the file is removed.
+		return nil, nil, errors.New("readahead: Detach cannot be used with WithSpill")
+	}
+	a.stop()
+	a.collect()
+	bufs := a.pending
+	if a.cur != nil {
+		bufs = append([]*buffer{a.cur}, bufs...)
+	}
+	if a.err == nil {
+		for _, b := range bufs {
+			leftover = append(leftover, b.buffer()...)
+			if b.err != nil {
+				if b.err != io.EOF {
+					err = b.err
+				}
+				break
+			}
+		}
+	} else if a.err != io.EOF {
+		err = a.err
+	}
+	a.cur = nil
+	a.pending = nil
+	a.closer = nil
+	a.err = errors.New("readahead: read after Detach")
+	return a.in, leftover, err
+}
+
+// Close will ensure that the underlying async reader is shut down.
+// It will also close the input supplied on newAsyncReader,
+// followed by any closers added with WithClosers.
+// If several closers fail, the first error is returned.
+//
+// Close is safe to call concurrently. The closers are only called once,
+// and only the first call will return their error.
+// Other calls wait for the first to finish and return nil.
+//
+// Close can be called while a Read is running on another goroutine.
+// A Read waiting for data returns ErrClosed, and Close waits for a Read
+// copying data to return it together with ErrClosed, so no data is lost.
+func (a *reader) Close() (err error) {
+	a.closeOnce.Do(func() {
+		err = a.close()
+	})
+	return err
+}
+
+// DrainToEOF reads and discards the remaining input until EOF,
+// and returns the number of bytes discarded.
+// Data is not copied, so this is faster than copying to io.Discard.
+// If the input returns an error other than io.EOF, draining stops and the error is returned.
+func (a *reader) DrainToEOF() (n int64, err error) {
+	for {
+		buf, err := a.readBuffer()
+		n += int64(len(buf))
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// ReadAllLimit reads until the end of the input like io.ReadAll,
+// but reads at most max bytes.
+// If the input has more data, the first max bytes are returned with ErrLimitExceeded,
+// and the following data can still be read.
+// While it runs, reading ahead stops at most one buffer past the limit,
+// but data read ahead before the call is kept.
+// Other errors are returned with the data read before the error.
+func (a *reader) ReadAllLimit(max int64) ([]byte, error) {
+	if max < 0 {
+		return nil, errors.New("readahead: negative limit")
+	}
+	atomic.StoreInt64(&a.fillMax, atomic.LoadInt64(&a.used)+max+1)
+	defer func() {
+		atomic.StoreInt64(&a.fillMax, 0)
+		a.signalWake()
+	}()
+	size := max
+	if all := int64(a.buffers) * int64(a.size); size > all {
+		size = all
+	}
+	b := make([]byte, 0, size)
+	for int64(len(b)) < max {
+		if len(b) == cap(b) {
+			// Let append pick the new size.
+			b = append(b, 0)[:len(b)]
+		}
+		dst := b[len(b):cap(b)]
+		if rem := max - int64(len(b)); int64(len(dst)) > rem {
+			dst = dst[:rem]
+		}
+		n, err := a.Read(dst)
+		b = b[:len(b)+n]
+		if err != nil && (err == io.EOF || err == a.eofErr) {
+			// Read returns the error set with WithEOFError at the end.
+			return b, nil
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	// Check if there is more without consuming it.
+	if _, err := a.peek(1); err == nil {
+		return b, ErrLimitExceeded
+	} else if err != io.EOF {
+		return b, err
+	}
+	return b, nil
+}
+
+// CloseDrain reads and discards the remaining input until EOF and then closes the reader.
+// This allows a connection to be reused, for example when closing an HTTP response body.
+// If more than max bytes remain, draining stops and ErrDrainLimit is returned after closing.
+// Data that has already been read ahead counts towards max.
+// If the input returns an error it is returned.
+// Otherwise any error from Close is returned.
+func (a *reader) CloseDrain(max int64) error {
+	var drained int64
+	var err error
+	for {
+		buf, rerr := a.readBuffer()
+		drained += int64(len(buf))
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			err = rerr
+			break
+		}
+		if drained > max {
+			err = ErrDrainLimit
+			break
+		}
+	}
+	if cerr := a.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// close shuts down the reader and calls closers.
+func (a *reader) close() (err error) {
+	if a.connUnblock {
+		// Unblock a pending read, so the async reader can exit.
+		if c, ok := a.in.(interface{ SetReadDeadline(t time.Time) error }); ok {
+			c.SetReadDeadline(time.Unix(1, 0))
+		}
+	}
+	if a.unblock != nil {
+		a.unblock()
+	}
+	if s, ok := a.in.(*spillReader); ok {
+		s.Close()
+	}
+	// Wake a Read waiting for data, and wait for it to return.
+	if a.closing != nil {
+		close(a.closing)
+	}
+	a.readMu.Lock()
+	a.stop()
+	a.closed = true
+	// Nothing is buffered once closed.
+	atomic.StoreInt64(&a.filled, atomic.LoadInt64(&a.used))
+	if a.expireTimer != nil {
+		a.expireTimer.Stop()
+	}
+	if a.zeroOnReuse {
+		a.zeroBuffers()
+	}
+	if a.release != nil {
+		for _, buf := range a.bufs {
+			a.releaseBuf(buf)
+		}
+		// Retired buffers are not in bufs.
+		for _, b := range append(a.pending, a.cur, a.held) {
+			if b != nil && b.retired {
+				a.releaseBuf(b.buf[:b.size])
+			}
+		}
+		// The buffers belong to the caller now.
+		a.bufs = nil
+		a.cur, a.pending, a.held = nil, nil, nil
+	}
+	a.err = ErrClosed
+	c, cs := a.closer, a.closers
+	a.closer, a.closers = nil, nil
+	a.readMu.Unlock()
+	if c != nil {
+		err = c.Close()
+	}
+	for _, c := range cs {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// zeroBuffers zeroes all buffers, including data that has been read ahead.
+// The async reader must be stopped.
+func (a *reader) zeroBuffers() {
+	a.collect()
+	for _, buf := range a.bufs {
+		zero(buf[:cap(buf)])
+	}
+	// Retired buffers are not in bufs.
+	for _, b := range append(a.pending, a.cur, a.held) {
+		if b != nil {
+			zero(b.buf[:cap(b.buf)])
+		}
+	}
+}
+
+// zero sets all bytes of b to 0.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// eofError returns the error set with WithEOFError if err is io.EOF,
+// and otherwise err.
+func (a *reader) eofError(err error) error {
+	if err == io.EOF && a.eofErr != nil {
+		return a.eofErr
+	}
+	return err
+}
+
+// enterUse marks the reader as in use by the consumer.
+// It panics if the reader is already in use by another goroutine.
+func (a *reader) enterUse() {
+	if !atomic.CompareAndSwapInt32(&a.inUse, 0, 1) {
+		panic("readahead: concurrent use of reader")
+	}
+}
+
+// leaveUse marks the reader as no longer in use.
+func (a *reader) leaveUse() {
+	atomic.StoreInt32(&a.inUse, 0)
+}
+
+// rightSize returns the number of buffers and buffer size to use
+// for an input of the expected size.
+// A buffer can hold the input and detect the end of it,
+// and at least 2 buffers are kept if requested, in case the input is larger.
+func rightSize(expected int64, buffers, size int) (int, int) {
+	need := expected + 1
+	if need < int64(size) {
+		size = int(need)
+	}
+	n := (need + int64(size) - 1) / int64(size)
+	if n < 2 {
+		n = 2
+	}
+	if n < int64(buffers) {
+		buffers = int(n)
+	}
+	return buffers, size
+}
+
+// releaseBuf calls the function set with WithReleaseFunc with buf, if any.
+// The async reader must not be able to use buf.
+func (a *reader) releaseBuf(buf []byte) {
+	if a.release != nil {
+		a.release(buf)
+	}
+}
+
+// prefault writes a zero to every memory page of b,
+// so the pages are mapped before b is used.
+func prefault(b []byte) {
+	ps := os.Getpagesize()
+	for i := 0; i < len(b); i += ps {
+		b[i] = 0
+	}
+}
+
+// readerFunc is a function used as an io.Reader.
+type readerFunc func(p []byte) (int, error)
+
+func (r readerFunc) Read(p []byte) (int, error) {
+	return r(p)
+}
+
+// Internal buffer representing a single read.
+// If an error is present, it must be returned
+// once all buffer content has been served.
+type buffer struct {
+	buf     []byte
+	err     error
+	offset  int
+	size    int
+	retired bool // Don't reuse after it has been consumed
+	retries int  // Number of retried reads when filling the buffer
+	last    bool // The input returned EOF after the content of this buffer
+}
+
+func newBuffer(buf []byte) *buffer {
+	return &buffer{buf: buf, err: nil, size: len(buf)}
+}
+
+// isEmpty returns true is offset is at end of
+// buffer, or if the buffer is nil
+func (b *buffer) isEmpty() bool {
+	if b == nil {
+		return true
+	}
+	if len(b.buf)-b.offset <= 0 {
+		return true
+	}
+	return false
+}
+
+// readConfig contains the options used when filling a buffer.
+type readConfig struct {
+	maxDelay time.Duration // If > 0, max time to wait for a buffer to fill after the first data.
+	panics   bool          // Don't recover panics from the input.
+	maxRead  int           // If > 0, max size of each read from the input.
+	emptyEOF bool          // Treat a read returning no data and no error as io.EOF.
+	forward  bool          // Hand over the buffer after each read returning data.
+	mode     int32         // AccessMode, accessed atomically.
+
+	// Retry reads returning io.ErrUnexpectedEOF.
+	eofRetries int
+	eofBackoff time.Duration
+
+	// Stop at delimiter. delimMatched is owned by the async reader.
+	delim        []byte
+	delimNext    []int // KMP failure table
+	delimMatched int   // Bytes of delimiter matched at the end of the data read.
+}
+
+// scanDelim updates the delimiter match with p and
+// returns whether the delimiter ends at the end of p.
+// p must not be longer than the remaining part of the delimiter.
+func (cfg *readConfig) scanDelim(p []byte) bool {
+	m := cfg.delimMatched
+	for _, c := range p {
+		for m > 0 && cfg.delim[m] != c {
+			m = cfg.delimNext[m-1]
+		}
+		if cfg.delim[m] == c {
+			m++
+		}
+	}
+	cfg.delimMatched = m
+	return m == len(cfg.delim)
+}
+
+// read into start of the buffer from the supplied reader,
+// resets the offset and updates the size of the buffer.
+// Waiting between retries stops when closing or expired is closed.
+// Any error encountered during the read is returned.
+func (b *buffer) read(rd io.Reader, cfg *readConfig, closing, expired <-chan struct{}) (err error) {
+	defer func() {
+		if cfg.panics {
+			return
+		}
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic reading: %v", r)
+			b.err = err
+		}
+	}()
+
+	var n, retries int
+	var first time.Time
+	b.err = nil
+	b.retries = 0
+	b.last = false
+	buf := b.buf[0:b.size]
+	for n < b.size {
+		dst := buf
+		if cfg.maxRead > 0 && len(dst) > cfg.maxRead {
+			dst = dst[:cfg.maxRead]
+		}
+		if cfg.delim != nil {
+			// Never read past the delimiter.
+			if rem := len(cfg.delim) - cfg.delimMatched; len(dst) > rem {
+				dst = dst[:rem]
+			}
+		}
+		n2, err := rd.Read(dst)
+		if n2 < 0 || n2 > len(dst) {
+			// Don't trust any data from the read.
+			b.err = fmt.Errorf("readahead: input returned invalid count %d from read of %d bytes", n2, len(dst))
+			break
+		}
+		n += n2
+		if cfg.delim != nil && n2 > 0 && cfg.scanDelim(dst[:n2]) {
+			b.err = io.EOF
+			break
+		}
+		if err == io.ErrUnexpectedEOF && retries < cfg.eofRetries {
+			retries++
+			b.retries++
+			buf = buf[n2:]
+			select {
+			case <-time.After(cfg.eofBackoff):
+				continue
+			case <-closing:
+			case <-expired:
+			}
+			// Give up retrying when closed or timed out.
+			b.err = err
+			break
+		}
+		if err == nil && n2 == 0 && cfg.emptyEOF {
+			err = io.EOF
+		}
+		if err != nil {
+			b.err = err
+			break
+		}
 		buf = buf[n2:]
+		retries = 0
+		if n > 0 && (cfg.forward || AccessMode(atomic.LoadInt32(&cfg.mode)) == AccessRandom) {
+			break
+		}
+		if cfg.maxDelay > 0 && n > 0 {
+			if first.IsZero() {
+				first = time.Now()
+			} else if time.Since(first) >= cfg.maxDelay {
+				break
+			}
+		}
 	}
 	b.buf = b.buf[0:n]
 	b.offset = 0
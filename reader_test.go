@@ -3,14 +3,24 @@ package readahead_test
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/iotest"
+	"time"
 
 	"github.com/klauspost/readahead"
 )
@@ -584,7 +594,7 @@ func reads(buf io.Reader, m int) string {
 		nb += n
 		if err == io.EOF {
 			break
-		} else if err != nil && err != iotest.ErrTimeout {
+		} else if err != nil && !errors.Is(err, iotest.ErrTimeout) {
 			panic("Data: " + err.Error())
 		} else if err != nil {
 			break
@@ -601,6 +611,27 @@ func (d dummyReader) Read(dst []byte) (int, error) {
 	return d.readFN(dst)
 }
 
+type dummyWriter struct {
+	writeFN func([]byte) (int, error)
+}
+
+func (d dummyWriter) Write(p []byte) (int, error) {
+	return d.writeFN(p)
+}
+
+// waitFor waits until cond returns true, and fails the test
+// if that doesn't happen within 10 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func TestReaderPanic(t *testing.T) {
 	r := dummyReader{readFN: func(dst []byte) (int, error) {
 		panic("some underlying panic")
@@ -616,6 +647,56 @@ func TestReaderPanic(t *testing.T) {
 	}
 }
 
+func TestReaderCallbackPanic(t *testing.T) {
+	apis := map[string]func(ar io.Reader) error{
+		"ForEachBuffer": func(ar io.Reader) error {
+			return ar.(readahead.Reader).ForEachBuffer(context.Background(), func(b []byte) error {
+				panic("callback panic")
+			})
+		},
+		"WriteToFunc": func(ar io.Reader) error {
+			_, err := ar.(readahead.Reader).WriteToFunc(ioutil.Discard, func(written int64) {
+				panic("callback panic")
+			})
+			return err
+		},
+	}
+	for name, api := range apis {
+		t.Run(name, func(t *testing.T) {
+			cl := &testCloser{Reader: bytes.NewReader(make([]byte, 10000))}
+			ar, err := readahead.NewReadCloserSize(cl, 4, 100)
+			if err != nil {
+				t.Fatal("error when creating:", err)
+			}
+			if err := api(ar); err == nil || !strings.Contains(err.Error(), "callback panic") {
+				t.Fatal("want panic error, got", err)
+			}
+			if cl.closed != 1 {
+				t.Fatal("want input closed, got close count", cl.closed)
+			}
+			if _, err := ar.Read(make([]byte, 10)); err != readahead.ErrClosed {
+				t.Fatal("want", readahead.ErrClosed, "got", err)
+			}
+		})
+		t.Run(name+"/propagate", func(t *testing.T) {
+			cl := &testCloser{Reader: bytes.NewReader(make([]byte, 10000))}
+			ar, err := readahead.NewReadCloserSize(cl, 4, 100, readahead.WithPanicPropagation())
+			if err != nil {
+				t.Fatal("error when creating:", err)
+			}
+			defer func() {
+				if r := recover(); r != "callback panic" {
+					t.Fatal("want panic, got", r)
+				}
+				if cl.closed != 1 {
+					t.Fatal("want input closed, got close count", cl.closed)
+				}
+			}()
+			api(ar)
+		})
+	}
+}
+
 func TestReaderLatePanic(t *testing.T) {
 	var n int
 	var mu sync.Mutex
@@ -663,7 +744,7 @@ func TestReaderLateError(t *testing.T) {
 	// Copy the content to dst
 	var dst = &bytes.Buffer{}
 	_, err := io.Copy(dst, reader)
-	if err != theErr {
+	if !errors.Is(err, theErr) {
 		t.Fatalf("Want %#v, got %#v", theErr, err)
 	}
 	mu.Lock()
@@ -705,23 +786,32 @@ func TestReaderSizes(t *testing.T) {
 	}
 	texts[len(texts)-1] = all
 
+	type geometry struct{ buffers, size int }
+	var geometries []geometry
+	for l := 1; l < 10; l++ {
+		geometries = append(geometries, geometry{buffers: l, size: 100})
+	}
+	// A single buffer, where reading and consuming never overlap,
+	// with buffer sizes that need many handovers.
+	geometries = append(geometries, geometry{buffers: 1, size: 1}, geometry{buffers: 1, size: 7})
+
 	for h := 0; h < len(texts); h++ {
 		text := texts[h]
 		for i := 0; i < len(readMakers); i++ {
 			for j := 0; j < len(bufreaders); j++ {
 				for k := 0; k < len(bufsizes); k++ {
-					for l := 1; l < 10; l++ {
+					for _, g := range geometries {
 						readmaker := readMakers[i]
 						bufreader := bufreaders[j]
 						bufsize := bufsizes[k]
 						read := readmaker.fn(strings.NewReader(text))
 						buf := bufio.NewReaderSize(read, bufsize)
-						ar, _ := readahead.NewReaderSize(buf, l, 100)
+						ar, _ := readahead.NewReaderSize(buf, g.buffers, g.size)
 						s := bufreader.fn(ar)
 						// "timeout" expects the Reader to recover, asyncReader does not.
 						if s != text && readmaker.name != "timeout" {
-							t.Errorf("reader=%s fn=%s bufsize=%d want=%q got=%q",
-								readmaker.name, bufreader.name, bufsize, text, s)
+							t.Errorf("reader=%s fn=%s bufsize=%d buffers=%d size=%d want=%q got=%q",
+								readmaker.name, bufreader.name, bufsize, g.buffers, g.size, text, s)
 						}
 						err := ar.Close()
 						if err != nil {
@@ -734,6 +824,29 @@ func TestReaderSizes(t *testing.T) {
 	}
 }
 
+// Test WriteTo and Seek with a single buffer.
+func TestSeekerSingleBuffer(t *testing.T) {
+	all := strings.Repeat("0123456789", 10)
+	ar, err := readahead.NewReadSeekerSize(strings.NewReader(all), 1, 5)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	if _, err := ar.Read(make([]byte, 3)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if _, err := ar.Seek(10, io.SeekStart); err != nil {
+		t.Fatal("error when seeking:", err)
+	}
+	dst := &bytes.Buffer{}
+	if _, err := ar.(io.WriterTo).WriteTo(dst); err != nil {
+		t.Fatal("error when writing:", err)
+	}
+	if dst.String() != all[10:] {
+		t.Fatal("output mismatch")
+	}
+}
+
 // Test various input buffer sizes, number of buffers and read sizes.
 func TestReaderWriteTo(t *testing.T) {
 	var texts [31]string
@@ -761,7 +874,7 @@ func TestReaderWriteTo(t *testing.T) {
 						dst := &bytes.Buffer{}
 						wt := ar.(io.WriterTo)
 						_, err := wt.WriteTo(dst)
-						if err != nil && err != iotest.ErrTimeout {
+						if err != nil && !errors.Is(err, iotest.ErrTimeout) {
 							t.Fatal("Copy:", err)
 						}
 						s := dst.String()
@@ -799,3 +912,3890 @@ func Example() {
 	fmt.Println(dst.String())
 	// Output: Example data
 }
+
+func TestReaderFailFast(t *testing.T) {
+	theErr := errors.New("some error")
+	newInput := func() io.Reader {
+		var n int
+		return dummyReader{readFN: func(dst []byte) (int, error) {
+			if n >= 3 {
+				return 0, theErr
+			}
+			n++
+			return len(dst), nil
+		}}
+	}
+	// waitFailed waits until the async reader has seen the error.
+	waitFailed := func(ar io.ReadCloser) {
+		if err := ar.(readahead.Reader).WaitSaturated(context.Background()); !errors.Is(err, theErr) {
+			t.Fatalf("Want %#v, got %#v", theErr, err)
+		}
+	}
+
+	// Default is to return data before the error.
+	ar, err := readahead.NewReaderSize(newInput(), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	waitFailed(ar)
+	n, err := io.Copy(ioutil.Discard, iotest.OneByteReader(ar))
+	if !errors.Is(err, theErr) {
+		t.Fatalf("Want %#v, got %#v", theErr, err)
+	}
+	if n != 300 {
+		t.Fatal("unexpected length, expected 300, got ", n)
+	}
+	ar.Close()
+
+	ar, err = readahead.NewReaderSize(newInput(), 4, 100, readahead.WithFailFast())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	waitFailed(ar)
+	n2, err := ar.Read(make([]byte, 10))
+	if !errors.Is(err, theErr) {
+		t.Fatalf("Want %#v, got %#v", theErr, err)
+	}
+	if n2 != 0 {
+		t.Fatal("unexpected length, expected 0, got ", n2)
+	}
+	// Error should be sticky.
+	_, err = ar.Read(make([]byte, 10))
+	if !errors.Is(err, theErr) {
+		t.Fatalf("Want %#v, got %#v", theErr, err)
+	}
+	err = ar.Close()
+	if err != nil {
+		t.Fatal("error when closing:", err)
+	}
+}
+
+func TestReaderResize(t *testing.T) {
+	input := make([]byte, 100000)
+	for i := range input {
+		input[i] = byte(i * 7 / 3)
+	}
+	sizes := [][2]int{{8, 100}, {2, 100}, {2, 1000}, {1, 17}, {16, 17}, {4, 4096}}
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	rs := ar.(readahead.Reader)
+	var got []byte
+	dst := make([]byte, 150)
+	for _, sz := range sizes {
+		n, err := io.ReadFull(ar, dst)
+		if err != nil {
+			t.Fatal("error when reading:", err)
+		}
+		got = append(got, dst[:n]...)
+		if err := rs.Resize(sz[0], sz[1]); err != nil {
+			t.Fatal("error when resizing:", err)
+		}
+	}
+	if err := rs.Resize(0, 100); err == nil {
+		t.Fatal("expected error when resizing, but got nil")
+	}
+	if err := rs.Resize(4, 0); err == nil {
+		t.Fatal("expected error when resizing, but got nil")
+	}
+	rest, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	got = append(got, rest...)
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+	// Resize at EOF is a no-op.
+	if err := rs.Resize(2, 100); err != nil {
+		t.Fatal("error when resizing:", err)
+	}
+	err = ar.Close()
+	if err != nil {
+		t.Fatal("error when closing:", err)
+	}
+	if err := rs.Resize(2, 100); err == nil {
+		t.Fatal("expected error when resizing after close, but got nil")
+	}
+
+	// Resize when input has been read to EOF.
+	ar, err = readahead.NewReaderSize(bytes.NewReader(input[:250]), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if err := ar.(readahead.Reader).WaitSaturated(context.Background()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	n, err := ar.Read(dst[:10])
+	if err != nil || n != 10 {
+		t.Fatal("error when reading:", n, err)
+	}
+	if err := ar.(readahead.Reader).Resize(1, 10); err != nil {
+		t.Fatal("error when resizing:", err)
+	}
+	rest, err = ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(rest, input[10:250]) {
+		t.Fatal("output mismatch")
+	}
+	ar.Close()
+}
+
+func TestReaderOffset(t *testing.T) {
+	input := make([]byte, 10000)
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if _, ok := ar.(io.Seeker); !ok {
+		t.Fatal("expected seekable reader")
+	}
+	off := ar.(readahead.Reader)
+	if got := off.Offset(); got != 0 {
+		t.Fatal("unexpected offset, expected 0, got", got)
+	}
+	_, err = io.ReadFull(ar, make([]byte, 250))
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if got := off.Offset(); got != 250 {
+		t.Fatal("unexpected offset, expected 250, got", got)
+	}
+	_, err = ar.(io.Seeker).Seek(5000, io.SeekStart)
+	if err != nil {
+		t.Fatal("error when seeking:", err)
+	}
+	if got := off.Offset(); got != 5000 {
+		t.Fatal("unexpected offset, expected 5000, got", got)
+	}
+	_, err = io.Copy(ioutil.Discard, ar)
+	if err != nil {
+		t.Fatal("error when copying:", err)
+	}
+	if got := off.Offset(); got != 10000 {
+		t.Fatal("unexpected offset, expected 10000, got", got)
+	}
+	ar.Close()
+
+	// Non-seekable
+	ar, err = readahead.NewReaderSize(bytes.NewBuffer(input), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	_, err = io.ReadFull(ar, make([]byte, 123))
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if got := ar.(readahead.Reader).Offset(); got != 123 {
+		t.Fatal("unexpected offset, expected 123, got", got)
+	}
+	ar.Close()
+}
+
+func TestReaderLazyBuffers(t *testing.T) {
+	allocs := func(opts ...readahead.Option) uint64 {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		ar, err := readahead.NewReaderSize(bytes.NewBufferString("Testbuffer"), 4, 1<<20, opts...)
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		b, err := ioutil.ReadAll(ar)
+		if err != nil {
+			t.Fatal("error when reading:", err)
+		}
+		if string(b) != "Testbuffer" {
+			t.Fatal("output mismatch")
+		}
+		ar.Close()
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+	if got := allocs(readahead.WithLazyBuffers()); got >= 2<<20 {
+		t.Errorf("lazy buffers allocated %d bytes", got)
+	}
+	if got := allocs(); got < 4<<20 {
+		t.Errorf("expected at least 4MB allocated, got %d bytes", got)
+	}
+
+	// Large input must use all buffers.
+	input := make([]byte, 10000)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	ar, err := readahead.NewReaderSize(bytes.NewBuffer(input), 4, 100, readahead.WithLazyBuffers())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	b, err := ioutil.ReadAll(iotest.HalfReader(ar))
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(b, input) {
+		t.Fatal("output mismatch")
+	}
+	ar.Close()
+}
+
+func TestWriteToFunc(t *testing.T) {
+	input := make([]byte, 1050)
+	ar, err := readahead.NewReaderSize(bytes.NewBuffer(input), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	var dst bytes.Buffer
+	var calls int
+	var last int64
+	n, err := ar.(readahead.Reader).WriteToFunc(&dst, func(written int64) {
+		if written < last {
+			t.Errorf("progress went backwards: %d -> %d", last, written)
+		}
+		if int64(dst.Len()) != written {
+			t.Errorf("progress %d does not match written %d", written, dst.Len())
+		}
+		last = written
+		calls++
+	})
+	if err != nil {
+		t.Fatal("error when writing:", err)
+	}
+	if n != 1050 || last != 1050 {
+		t.Fatal("unexpected length, expected 1050, got ", n, last)
+	}
+	if calls < 11 {
+		t.Fatal("expected at least 11 progress calls, got", calls)
+	}
+	ar.Close()
+
+	// nil progress behaves like WriteTo.
+	ar, err = readahead.NewReaderSize(bytes.NewBuffer(input), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	n, err = ar.(readahead.Reader).WriteToFunc(ioutil.Discard, nil)
+	if err != nil || n != 1050 {
+		t.Fatal("unexpected result:", n, err)
+	}
+	ar.Close()
+}
+
+func TestReaderCoalesce(t *testing.T) {
+	// countReads returns the number of reads needed to read all data.
+	// Each Read returns data from at most one buffer.
+	countReads := func(in io.Reader, opts ...readahead.Option) int {
+		ar, err := readahead.NewReaderSize(in, 4, 100, opts...)
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		defer ar.Close()
+		var reads, total int
+		dst := make([]byte, 1000)
+		for {
+			n, err := ar.Read(dst)
+			total += n
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal("error when reading:", err)
+			}
+			reads++
+		}
+		if total != 200 {
+			t.Fatal("unexpected length, expected 200, got", total)
+		}
+		return reads
+	}
+	input := make([]byte, 200)
+	if got := countReads(iotest.OneByteReader(bytes.NewReader(input)), readahead.WithCoalesce(time.Hour)); got != 2 {
+		t.Errorf("expected 2 buffers, got %d", got)
+	}
+	src := iotest.OneByteReader(bytes.NewReader(input))
+	slow := dummyReader{readFN: func(p []byte) (int, error) {
+		time.Sleep(time.Millisecond)
+		return src.Read(p)
+	}}
+	if got := countReads(slow, readahead.WithCoalesce(5*time.Millisecond)); got <= 2 {
+		t.Errorf("expected more than 2 buffers, got %d", got)
+	}
+	_, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 100, readahead.WithCoalesce(0))
+	if err == nil {
+		t.Fatal("expected error when creating, but got nil")
+	}
+}
+
+func TestReadBuffer(t *testing.T) {
+	input := make([]byte, 1050)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	// Partially consume first buffer.
+	_, err = io.ReadFull(ar, make([]byte, 30))
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	got := make([]byte, 30)
+	copy(got, input)
+	br := ar.(readahead.Reader)
+	var sizes []int
+	for {
+		b, err := br.ReadBuffer()
+		got = append(got, b...)
+		if err == io.EOF {
+			if len(b) != 0 {
+				t.Fatal("unexpected data with EOF")
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal("error when reading:", err)
+		}
+		sizes = append(sizes, len(b))
+	}
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+	want := []int{70, 100, 100, 100, 100, 100, 100, 100, 100, 100, 50}
+	if fmt.Sprint(sizes) != fmt.Sprint(want) {
+		t.Fatalf("unexpected buffer sizes, want %v, got %v", want, sizes)
+	}
+	if _, err := br.ReadBuffer(); err != io.EOF {
+		t.Fatal("expected io.EOF, got", err)
+	}
+	ar.Close()
+}
+
+func TestReaderWithCloser(t *testing.T) {
+	cl := &testCloser{}
+	ar, err := readahead.NewReaderSize(bytes.NewBufferString("Testbuffer"), 4, 100, readahead.WithCloser(cl))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	err = ar.Close()
+	if err != nil {
+		t.Fatal("error when closing:", err)
+	}
+	err = ar.Close()
+	if err != nil {
+		t.Fatal("error when closing:", err)
+	}
+	if cl.closed != 1 {
+		t.Fatal("want close count 1, got:", cl.closed)
+	}
+
+	// Error forwarding
+	cl = &testCloser{onClose: errors.New("an error")}
+	ar, err = readahead.NewReaderBuffer(bytes.NewBufferString("Testbuffer"), makeBuffers(4, 100), readahead.WithCloser(cl))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	err = ar.Close()
+	if err != cl.onClose {
+		t.Fatal("want error when closing, got", err)
+	}
+	if cl.closed != 1 {
+		t.Fatal("want close count 1, got:", cl.closed)
+	}
+
+	_, err = readahead.NewReaderSize(bytes.NewBufferString("Testbuffer"), 4, 100, readahead.WithCloser(nil))
+	if err == nil {
+		t.Fatal("expected error when creating, but got nil")
+	}
+}
+
+type endCountSeeker struct {
+	*bytes.Reader
+	ends int
+}
+
+func (e *endCountSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekEnd {
+		e.ends++
+	}
+	return e.Reader.Seek(offset, whence)
+}
+
+func TestSeekerRefreshSize(t *testing.T) {
+	input := []byte("Testbuffer")
+	in := &endCountSeeker{Reader: bytes.NewReader(input)}
+	ar, err := readahead.NewReadSeekerSize(in, 4, 3, readahead.WithRefreshSize(0))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	for i := 1; i < 5; i++ {
+		pos, err := ar.Seek(int64(-i), io.SeekEnd)
+		if err != nil {
+			t.Fatal("error when seeking:", err)
+		}
+		if pos != int64(len(input)-i) {
+			t.Fatal("unexpected position, expected", len(input)-i, "got", pos)
+		}
+		b, err := ioutil.ReadAll(ar)
+		if err != nil {
+			t.Fatal("error when reading:", err)
+		}
+		if string(b) != string(input[len(input)-i:]) {
+			t.Fatalf("unexpected content %q", b)
+		}
+	}
+	if in.ends != 1 {
+		t.Fatal("expected 1 seek to end, got", in.ends)
+	}
+	ar.Close()
+
+	// Without caching all seeks are forwarded.
+	in = &endCountSeeker{Reader: bytes.NewReader(input)}
+	ar, err = readahead.NewReadSeekerSize(in, 4, 3)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	for i := 1; i < 5; i++ {
+		if _, err := ar.Seek(int64(-i), io.SeekEnd); err != nil {
+			t.Fatal("error when seeking:", err)
+		}
+	}
+	if in.ends != 4 {
+		t.Fatal("expected 4 seeks to end, got", in.ends)
+	}
+	ar.Close()
+}
+
+type failOnceSeeker struct {
+	*bytes.Reader
+	failed bool
+}
+
+func (f *failOnceSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart && !f.failed {
+		f.failed = true
+		return 0, errors.New("seek failed")
+	}
+	return f.Reader.Seek(offset, whence)
+}
+
+func TestSeekerSeekError(t *testing.T) {
+	input := []byte("0123456789abcdef")
+	ar, err := readahead.NewReadSeekerSize(&failOnceSeeker{Reader: bytes.NewReader(input)}, 2, 4)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	got := make([]byte, 3)
+	if _, err := io.ReadFull(ar, got); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if _, err := ar.Seek(10, io.SeekStart); err == nil {
+		t.Fatal("expected error when seeking, but got nil")
+	}
+	// Reading continues at the old position.
+	rest, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(append(got, rest...), input) {
+		t.Fatalf("want %q, got %q", input, append(got, rest...))
+	}
+	if pos, err := ar.Seek(10, io.SeekStart); err != nil || pos != 10 {
+		t.Fatalf("want 10, <nil>, got %d, %v", pos, err)
+	}
+	if rest, err := ioutil.ReadAll(ar); err != nil || !bytes.Equal(rest, input[10:]) {
+		t.Fatalf("want %q, <nil>, got %q, %v", input[10:], rest, err)
+	}
+}
+
+func TestWaitSaturated(t *testing.T) {
+	var mu sync.Mutex
+	var total int
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		total += len(dst)
+		return len(dst), nil
+	}}
+	ar, err := readahead.NewReaderSize(r, 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if err := ar.(readahead.Reader).WaitSaturated(context.Background()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	mu.Lock()
+	if total != 400 {
+		t.Error("expected 400 bytes read, got", total)
+	}
+	mu.Unlock()
+	ar.Close()
+
+	// Short input
+	ar, err = readahead.NewReaderSize(bytes.NewBufferString("Testbuffer"), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if err := ar.(readahead.Reader).WaitSaturated(context.Background()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	ar.Close()
+
+	// Failing input
+	theErr := errors.New("some error")
+	ar, err = readahead.NewReaderSize(dummyReader{readFN: func(dst []byte) (int, error) {
+		return 0, theErr
+	}}, 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if err := ar.(readahead.Reader).WaitSaturated(context.Background()); err != theErr {
+		t.Fatalf("Want %#v, got %#v", theErr, err)
+	}
+	ar.Close()
+
+	// Blocking input
+	block := make(chan struct{})
+	ar, err = readahead.NewReaderSize(dummyReader{readFN: func(dst []byte) (int, error) {
+		<-block
+		return 0, io.EOF
+	}}, 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := ar.(readahead.Reader).WaitSaturated(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expected deadline exceeded, got", err)
+	}
+	close(block)
+	ar.Close()
+}
+
+func TestReaderRecordSize(t *testing.T) {
+	input := make([]byte, 1003)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	for _, rm := range readMakers[:4] {
+		ar, err := readahead.NewReaderSize(rm.fn(bytes.NewReader(input)), 4, 64, readahead.WithRecordSize(10))
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		if _, err := ar.Read(make([]byte, 9)); err != io.ErrShortBuffer {
+			t.Fatal("expected io.ErrShortBuffer, got", err)
+		}
+		var got []byte
+		dst := make([]byte, 25)
+		for {
+			n, err := ar.Read(dst)
+			got = append(got, dst[:n]...)
+			if err == io.EOF {
+				if n%10 != 3 && n != 0 {
+					t.Fatalf("%s: unexpected trailing read of %d bytes", rm.name, n)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatal("error when reading:", err)
+			}
+			if n == 0 || n%10 != 0 {
+				t.Fatalf("%s: read %d bytes, not a multiple of the record size", rm.name, n)
+			}
+		}
+		if !bytes.Equal(got, input) {
+			t.Fatalf("%s: output mismatch", rm.name)
+		}
+		ar.Close()
+	}
+	_, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 64, readahead.WithRecordSize(0))
+	if err == nil {
+		t.Fatal("expected error when creating, but got nil")
+	}
+}
+
+func TestReaderPanicPropagation(t *testing.T) {
+	if os.Getenv("READAHEAD_TEST_PANIC") == "1" {
+		r := dummyReader{readFN: func(dst []byte) (int, error) {
+			panic("some underlying panic")
+		}}
+		reader, _ := readahead.NewReaderSize(r, 4, 100, readahead.WithPanicPropagation())
+		io.Copy(ioutil.Discard, reader)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestReaderPanicPropagation$")
+	cmd.Env = append(os.Environ(), "READAHEAD_TEST_PANIC=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatal("expected the program to crash")
+	}
+	if !strings.Contains(string(out), "some underlying panic") {
+		t.Fatalf("expected panic in output, got %s", out)
+	}
+}
+
+func TestReaderFillFunc(t *testing.T) {
+	src := strings.NewReader("Testbuffer")
+	var calls int
+	fill := func(buf []byte) (int, error) {
+		calls++
+		return src.Read(buf)
+	}
+	// The input is not read when a fill function is used.
+	in := dummyReader{readFN: func(dst []byte) (int, error) {
+		panic("input was read")
+	}}
+	ar, err := readahead.NewReaderSize(in, 4, 4, readahead.WithFillFunc(fill))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	b, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if string(b) != "Testbuffer" {
+		t.Fatalf("unexpected content %q", b)
+	}
+	if calls < 3 {
+		t.Fatal("expected at least 3 calls, got", calls)
+	}
+	ar.Close()
+
+	_, err = readahead.NewReaderSize(in, 4, 4, readahead.WithFillFunc(nil))
+	if err == nil {
+		t.Fatal("expected error when creating, but got nil")
+	}
+}
+
+type flakyWriter struct {
+	bytes.Buffer
+	writes int
+	err    error
+}
+
+// Write will fail every other write after writing half the data.
+func (f *flakyWriter) Write(p []byte) (int, error) {
+	f.writes++
+	if f.writes%2 == 0 {
+		n, _ := f.Buffer.Write(p[:len(p)/2])
+		return n, f.err
+	}
+	return f.Buffer.Write(p)
+}
+
+func TestWriteToRetry(t *testing.T) {
+	input := make([]byte, 1050)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	transient := errors.New("transient")
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 100, readahead.WithWriteRetry(func(err error) bool {
+		return err == transient
+	}))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	dst := &flakyWriter{err: transient}
+	n, err := ar.(io.WriterTo).WriteTo(dst)
+	if err != nil {
+		t.Fatal("error when writing:", err)
+	}
+	if n != int64(len(input)) || !bytes.Equal(dst.Bytes(), input) {
+		t.Fatal("output mismatch", n)
+	}
+	ar.Close()
+
+	// Permanent errors are returned.
+	permanent := errors.New("permanent")
+	ar, err = readahead.NewReaderSize(bytes.NewReader(input), 4, 100, readahead.WithWriteRetry(func(err error) bool {
+		return err == transient
+	}))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	dst = &flakyWriter{err: permanent}
+	n, err = ar.(io.WriterTo).WriteTo(dst)
+	if err != permanent {
+		t.Fatal("expected permanent error, got", err)
+	}
+	if n != int64(dst.Len()) {
+		t.Fatal("unexpected length, expected", dst.Len(), "got", n)
+	}
+	ar.Close()
+}
+
+func TestWriteToRetryContext(t *testing.T) {
+	transient := errors.New("transient")
+	ar, err := readahead.NewReaderSize(bytes.NewReader(make([]byte, 100)), 4, 100, readahead.WithWriteRetry(func(err error) bool {
+		return err == transient
+	}))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Cancel once the backoff has grown to 1 second.
+	var writes int
+	var cancelled time.Time
+	w := dummyWriter{writeFN: func(p []byte) (int, error) {
+		if writes++; writes == 11 {
+			cancelled = time.Now()
+			cancel()
+		}
+		return 0, transient
+	}}
+	_, err = ar.(readahead.Reader).WriteToContext(ctx, w)
+	if err != context.Canceled {
+		t.Fatal("want context.Canceled, got", err)
+	}
+	if d := time.Since(cancelled); d > 500*time.Millisecond {
+		t.Fatal("WriteToContext kept waiting after cancel for", d)
+	}
+}
+
+func TestPeekAvailable(t *testing.T) {
+	input := make([]byte, 250)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	// Wait for all to be read.
+	if err := ar.(readahead.Reader).WaitSaturated(context.Background()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	got := ar.(readahead.Reader).PeekAvailable()
+	if !bytes.Equal(got, input) {
+		t.Fatalf("unexpected peek, got %d bytes", len(got))
+	}
+	_, err = io.ReadFull(ar, make([]byte, 120))
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	got = ar.(readahead.Reader).PeekAvailable()
+	if !bytes.Equal(got, input[120:]) {
+		t.Fatalf("unexpected peek, got %d bytes", len(got))
+	}
+	// Peeked data must still be returned.
+	b, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(b, input[120:]) {
+		t.Fatal("output mismatch")
+	}
+	if got := ar.(readahead.Reader).PeekAvailable(); len(got) != 0 {
+		t.Fatal("expected nothing available, got", len(got))
+	}
+	ar.Close()
+}
+
+type orderCloser struct {
+	testCloser
+	order *[]int
+	id    int
+}
+
+func (o *orderCloser) Close() error {
+	*o.order = append(*o.order, o.id)
+	return o.testCloser.Close()
+}
+
+func TestReaderWithClosers(t *testing.T) {
+	var order []int
+	err1, err2 := errors.New("error 1"), errors.New("error 2")
+	cls := []*orderCloser{
+		{order: &order, id: 1},
+		{order: &order, id: 2, testCloser: testCloser{onClose: err1}},
+		{order: &order, id: 3, testCloser: testCloser{onClose: err2}},
+		{order: &order, id: 4},
+	}
+	in := &orderCloser{order: &order, id: 0, testCloser: testCloser{Reader: bytes.NewBufferString("Testbuffer")}}
+	ar, err := readahead.NewReadCloserSize(in, 4, 100, readahead.WithClosers(cls[0], cls[1]), readahead.WithClosers(cls[2], cls[3]))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	err = ar.Close()
+	if err != err1 {
+		t.Fatal("expected first error, got", err)
+	}
+	err = ar.Close()
+	if err != nil {
+		t.Fatal("error when closing:", err)
+	}
+	if fmt.Sprint(order) != "[0 1 2 3 4]" {
+		t.Fatal("unexpected close order", order)
+	}
+	for _, c := range append(cls, in) {
+		if c.closed != 1 {
+			t.Fatal("want close count 1, got:", c.closed)
+		}
+	}
+	_, err = readahead.NewReaderSize(bytes.NewBufferString("Testbuffer"), 4, 100, readahead.WithClosers(nil))
+	if err == nil {
+		t.Fatal("expected error when creating, but got nil")
+	}
+}
+
+func TestIsSeekable(t *testing.T) {
+	ar, err := readahead.NewReaderSize(bytes.NewReader([]byte("Testbuffer")), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if !readahead.IsSeekable(ar) {
+		t.Error("expected seekable reader")
+	}
+	ar.Close()
+	ar, err = readahead.NewReaderSize(bytes.NewBufferString("Testbuffer"), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if readahead.IsSeekable(ar) {
+		t.Error("expected reader not to be seekable")
+	}
+	ar.Close()
+	at, err := readahead.NewReaderAt(bytes.NewReader([]byte("Testbuffer")), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if !readahead.IsSeekable(at) {
+		t.Error("expected NewReaderAt reader to be seekable")
+	}
+	at.Close()
+	sat, err := readahead.NewSeekableReaderAt(bytes.NewReader([]byte("Testbuffer")), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if !readahead.IsSeekable(sat) {
+		t.Error("expected NewSeekableReaderAt reader to be seekable")
+	}
+	sat.Close()
+	// Seekable, but not from this package.
+	if readahead.IsSeekable(&testCloser{Reader: bytes.NewReader(nil)}) {
+		t.Error("expected unrelated reader not to be seekable")
+	}
+	if readahead.IsSeekable(nil) {
+		t.Error("expected nil not to be seekable")
+	}
+}
+
+func TestReaderInterfaces(t *testing.T) {
+	input := []byte("Testbuffer")
+	ar, err := readahead.NewReaderSize(bytes.NewBufferString("Testbuffer"), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	rd, ok := ar.(readahead.Reader)
+	if !ok {
+		t.Fatal("expected reader to implement Reader")
+	}
+	if _, ok := ar.(readahead.SeekableReader); ok {
+		t.Error("expected reader not to implement SeekableReader")
+	}
+	if got, err := rd.Peek(4); err != nil || string(got) != "Test" {
+		t.Fatalf("want %q, got %q, %v", "Test", got, err)
+	}
+
+	sr, err := readahead.NewReadSeekerSize(bytes.NewReader(input), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer sr.Close()
+	srd, ok := sr.(readahead.SeekableReader)
+	if !ok {
+		t.Fatal("expected seekable reader to implement SeekableReader")
+	}
+	var buf bytes.Buffer
+	if _, err := srd.WriteRange(&buf, 4, 6); err != nil || buf.String() != "buffer" {
+		t.Fatalf("want %q, got %q, %v", "buffer", buf.String(), err)
+	}
+
+	others := map[string]func() (io.ReadCloser, error){
+		"NewReaderAt": func() (io.ReadCloser, error) {
+			return readahead.NewReaderAt(bytes.NewReader(input), 4, 100)
+		},
+		"NewSeekableReaderAt": func() (io.ReadCloser, error) {
+			return readahead.NewSeekableReaderAt(bytes.NewReader(input), 4, 100)
+		},
+		"NewChannelReader": func() (io.ReadCloser, error) {
+			return readahead.NewChannelReader(make(chan []byte), 4, 100)
+		},
+		"NewReaderDeterministic": func() (io.ReadCloser, error) {
+			return readahead.NewReaderDeterministic(bytes.NewReader(input), []int{3}, 4, 100)
+		},
+	}
+	for name, fn := range others {
+		rc, err := fn()
+		if err != nil {
+			t.Fatalf("%s: error when creating: %v", name, err)
+		}
+		if _, ok := rc.(readahead.Reader); !ok {
+			t.Errorf("%s: expected reader to implement Reader", name)
+		}
+		rc.Close()
+	}
+}
+
+func TestReaderConcurrentClose(t *testing.T) {
+	theErr := errors.New("an error")
+	for i := 0; i < 100; i++ {
+		cl := &testCloser{Reader: bytes.NewBuffer(make([]byte, 50000)), onClose: theErr}
+		ar, err := readahead.NewReadCloserSize(cl, 4, 100)
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- ar.Close()
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		var got int
+		for err := range errs {
+			if err == theErr {
+				got++
+			} else if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+		}
+		if got != 1 {
+			t.Fatal("expected error to be returned once, got", got)
+		}
+		if cl.closed != 1 {
+			t.Fatal("want close count 1, got:", cl.closed)
+		}
+	}
+}
+
+func TestWriteToContext(t *testing.T) {
+	block := make(chan struct{})
+	var reads int
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		reads++
+		if reads > 3 {
+			<-block
+			return 0, io.EOF
+		}
+		return len(dst), nil
+	}}
+	ar, err := readahead.NewReaderSize(r, 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var dst bytes.Buffer
+	n, err := ar.(readahead.Reader).WriteToContext(ctx, &dst)
+	if err != context.DeadlineExceeded {
+		t.Fatal("expected deadline exceeded, got", err)
+	}
+	if n != 300 || dst.Len() != 300 {
+		t.Fatal("unexpected length, expected 300, got", n, dst.Len())
+	}
+	close(block)
+	n, err = ar.(readahead.Reader).WriteToContext(context.Background(), &dst)
+	if err != nil || n != 0 {
+		t.Fatal("unexpected result:", n, err)
+	}
+	ar.Close()
+}
+
+func TestReaderLazyStart(t *testing.T) {
+	var mu sync.Mutex
+	var reads int
+	src := strings.NewReader("Testbuffer")
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		mu.Lock()
+		reads++
+		mu.Unlock()
+		return src.Read(dst)
+	}}
+	ar, err := readahead.NewReaderSize(r, 4, 100, readahead.WithLazyStart())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	mu.Lock()
+	if reads != 0 {
+		t.Fatal("expected no reads before first Read, got", reads)
+	}
+	mu.Unlock()
+	b, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if string(b) != "Testbuffer" {
+		t.Fatalf("unexpected content %q", b)
+	}
+	ar.Close()
+
+	// Close before reading.
+	cl := &testCloser{Reader: r}
+	ar, err = readahead.NewReadCloserSize(cl, 4, 100, readahead.WithLazyStart())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	err = ar.Close()
+	if err != nil {
+		t.Fatal("error when closing:", err)
+	}
+	if cl.closed != 1 {
+		t.Fatal("want close count 1, got:", cl.closed)
+	}
+	_, err = ar.Read(make([]byte, 10))
+	if err == nil {
+		t.Fatal("want error when closing, got:", err)
+	}
+}
+
+func TestReaderDetach(t *testing.T) {
+	input := make([]byte, 10000)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	cl := &testCloser{Reader: bytes.NewBuffer(input)}
+	ar, err := readahead.NewReadCloserSize(cl, 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	got := make([]byte, 150)
+	_, err = io.ReadFull(ar, got)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	in, leftover, err := ar.(readahead.Reader).Detach()
+	if err != nil {
+		t.Fatal("error when detaching:", err)
+	}
+	if in != cl {
+		t.Fatal("unexpected input returned")
+	}
+	if len(leftover) < 50 {
+		t.Fatal("expected at least 50 bytes leftover, got", len(leftover))
+	}
+	rest, err := ioutil.ReadAll(io.MultiReader(bytes.NewReader(leftover), in))
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	got = append(got, rest...)
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+	if _, err := ar.Read(make([]byte, 10)); err == nil {
+		t.Fatal("expected error reading after Detach")
+	}
+	if err := ar.Close(); err != nil {
+		t.Fatal("error when closing:", err)
+	}
+	if cl.closed != 0 {
+		t.Fatal("input should not be closed after Detach")
+	}
+}
+
+func TestReaderName(t *testing.T) {
+	ar, err := readahead.NewReaderSize(bytes.NewBufferString("Testbuffer"), 4, 100, readahead.WithName("input"))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if got := ar.(readahead.Reader).Name(); got != "input" {
+		t.Fatalf("unexpected name %q", got)
+	}
+	ar.Close()
+	ar, err = readahead.NewReaderSize(bytes.NewBufferString("Testbuffer"), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if got := ar.(readahead.Reader).Name(); got != "" {
+		t.Fatalf("unexpected name %q", got)
+	}
+	ar.Close()
+}
+
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Buffer.Write(p)
+}
+
+func TestWriteToCoalesce(t *testing.T) {
+	input := make([]byte, 1000)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 200, 5, readahead.WithWriteCoalesce(100))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	err = ar.(readahead.Reader).WaitSaturated(context.Background())
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	dst := &countingWriter{}
+	n, err := ar.(io.WriterTo).WriteTo(dst)
+	if err != nil {
+		t.Fatal("error when writing:", err)
+	}
+	if n != 1000 || !bytes.Equal(dst.Bytes(), input) {
+		t.Fatal("output mismatch", n)
+	}
+	if dst.writes > 20 {
+		t.Error("expected at most 20 writes, got", dst.writes)
+	}
+	ar.Close()
+
+	// Partial writes must not lose data.
+	transient := errors.New("transient")
+	for _, rm := range readMakers[:4] {
+		ar, err = readahead.NewReaderSize(rm.fn(bytes.NewReader(input)), 8, 7,
+			readahead.WithWriteCoalesce(30),
+			readahead.WithWriteRetry(func(err error) bool { return err == transient }))
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		fw := &flakyWriter{err: transient}
+		n, err = ar.(io.WriterTo).WriteTo(fw)
+		if err != nil {
+			t.Fatal("error when writing:", err)
+		}
+		if n != 1000 || !bytes.Equal(fw.Bytes(), input) {
+			t.Fatal(rm.name, "output mismatch", n)
+		}
+		ar.Close()
+	}
+}
+
+func TestReaderMaxReadSize(t *testing.T) {
+	input := make([]byte, 1005)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	for _, rm := range readMakers[:4] {
+		src := rm.fn(bytes.NewReader(input))
+		var reads int
+		r := dummyReader{readFN: func(dst []byte) (int, error) {
+			if len(dst) > 30 {
+				t.Errorf("read of %d bytes exceeds max", len(dst))
+			}
+			reads++
+			return src.Read(dst)
+		}}
+		ar, err := readahead.NewReaderSize(r, 4, 100, readahead.WithMaxReadSize(30))
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		var dst bytes.Buffer
+		_, err = ar.(io.WriterTo).WriteTo(&dst)
+		if err != nil {
+			t.Fatal("error when writing:", err)
+		}
+		if !bytes.Equal(dst.Bytes(), input) {
+			t.Fatal(rm.name, "output mismatch")
+		}
+		// Data must be read in small reads.
+		if reads < 1005/30 {
+			t.Errorf("expected at least %d reads, got %d", 1005/30, reads)
+		}
+		ar.Close()
+	}
+}
+
+func TestReadVec(t *testing.T) {
+	input := make([]byte, 1000)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	ar, err := readahead.NewReaderSize(iotest.HalfReader(bytes.NewReader(input)), 4, 64)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	vr := ar.(readahead.Reader)
+	var got []byte
+	for {
+		a, b, c := make([]byte, 3), make([]byte, 70), make([]byte, 200)
+		n, err := vr.ReadVec(a, b, c)
+		all := append(append(a, b...), c...)
+		got = append(got, all[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("error when reading:", err)
+		}
+		if n != len(all) {
+			t.Fatal("expected all slices to be filled, got", n)
+		}
+	}
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+	ar.Close()
+}
+
+func TestReaderStopDelimiter(t *testing.T) {
+	tests := []struct {
+		input, delim, want string
+	}{
+		{input: "hello world\nmore data", delim: "\n", want: "hello world\n"},
+		{input: "abababac-rest", delim: "ababac", want: "abababac"},
+		{input: "aaaaab", delim: "aab", want: "aaaaab"},
+		{input: "no delimiter here", delim: "END", want: "no delimiter here"},
+		{input: strings.Repeat("x", 250) + "--END--tail", delim: "--END--", want: strings.Repeat("x", 250) + "--END--"},
+	}
+	for _, test := range tests {
+		for _, size := range []int{1, 3, 16, 100} {
+			src := strings.NewReader(test.input)
+			ar, err := readahead.NewReaderSize(src, 4, size, readahead.WithStopDelimiter([]byte(test.delim)))
+			if err != nil {
+				t.Fatal("error when creating:", err)
+			}
+			got, err := ioutil.ReadAll(ar)
+			if err != nil {
+				t.Fatal("error when reading:", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("size %d: want %q, got %q", size, test.want, got)
+			}
+			// The input must be positioned after the delimiter.
+			rest, _ := ioutil.ReadAll(src)
+			if string(rest) != test.input[len(test.want):] {
+				t.Errorf("size %d: want remaining %q, got %q", size, test.input[len(test.want):], rest)
+			}
+			ar.Close()
+		}
+	}
+	_, err := readahead.NewReaderSize(strings.NewReader(""), 4, 10, readahead.WithStopDelimiter(nil))
+	if err == nil {
+		t.Fatal("expected error when creating, but got nil")
+	}
+}
+
+func TestReaderQueueDepth(t *testing.T) {
+	input := make([]byte, 10000)
+	for i := range input {
+		input[i] = byte(i * 7 / 3)
+	}
+	var read int64
+	src := bytes.NewReader(input)
+	rd := dummyReader{readFN: func(dst []byte) (int, error) {
+		n, err := src.Read(dst)
+		atomic.AddInt64(&read, int64(n))
+		return n, err
+	}}
+	blocked := make(chan struct{}, 1)
+	ar, err := readahead.NewReaderSize(rd, 8, 100, readahead.WithQueueDepth(1), readahead.WithBackpressureCallback(func(s readahead.State) {
+		if s == readahead.StateConsumerBound {
+			select {
+			case blocked <- struct{}{}:
+			default:
+			}
+		}
+	}))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	sat := ar.(readahead.Reader)
+	// One queued buffer and one waiting to be queued.
+	select {
+	case <-blocked:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the queue to fill")
+	}
+	if n := atomic.LoadInt64(&read); n > 200 {
+		t.Fatalf("read %d bytes ahead, want at most 200", n)
+	}
+	// Inspecting the buffers must not make room for reading further ahead.
+	for i := 0; i < 4; i++ {
+		if n := sat.Buffered(); n != 200 {
+			t.Fatalf("want 200 buffered, got %d", n)
+		}
+		if n, ok := sat.NextSize(); !ok || n != 100 {
+			t.Fatalf("want 100, true, got %d, %v", n, ok)
+		}
+		if got := sat.PeekAvailable(); !bytes.Equal(got, input[:200]) {
+			t.Fatalf("peeked %d bytes, want the first 200", len(got))
+		}
+	}
+	if n := atomic.LoadInt64(&read); n > 200 {
+		t.Fatalf("read %d bytes ahead, want at most 200", n)
+	}
+	// Data held by the async reader must survive Resize.
+	if err := sat.Resize(4, 50); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	// Buffered can be monitored while reading.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for atomic.LoadInt64(&read) < int64(len(input)) {
+			if n := sat.Buffered(); n < 0 || n > len(input) {
+				t.Errorf("buffered %d bytes", n)
+				return
+			}
+			runtime.Gosched()
+		}
+	}()
+	got, err := ioutil.ReadAll(ar)
+	<-done
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+	if err := ar.Close(); err != nil {
+		t.Fatal("error when closing:", err)
+	}
+
+	// Close must not block while the async reader waits.
+	ar, err = readahead.NewReaderSize(bytes.NewReader(input), 8, 100, readahead.WithQueueDepth(2))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	ar.(readahead.Reader).WaitSaturated(context.Background())
+	if err := ar.Close(); err != nil {
+		t.Fatal("error when closing:", err)
+	}
+
+	_, err = readahead.NewReaderSize(bytes.NewReader(input), 8, 100, readahead.WithQueueDepth(0))
+	if err == nil {
+		t.Fatal("expected error when creating, but got nil")
+	}
+}
+
+func TestReaderPrefetch(t *testing.T) {
+	input := []byte(strings.Repeat("prefetch ", 100))
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 8, 200, readahead.WithLazyStart())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if err := ar.(readahead.Reader).Prefetch(context.Background()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+	ar.Close()
+
+	// The input error is returned.
+	ar, err = readahead.NewReaderSize(iotest.TimeoutReader(bytes.NewReader(input)), 8, 200)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if err := ar.(readahead.Reader).Prefetch(context.Background()); err != iotest.ErrTimeout {
+		t.Fatalf("want error %v, got %v", iotest.ErrTimeout, err)
+	}
+	ar.Close()
+
+	// Input larger than the buffers blocks until ctx is done.
+	ar, err = readahead.NewReaderSize(bytes.NewReader(input), 2, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := ar.(readahead.Reader).Prefetch(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("want error %v, got %v", context.DeadlineExceeded, err)
+	}
+	ar.Close()
+}
+
+func TestReaderPeek(t *testing.T) {
+	for _, size := range []int{1, 2, 3, 10} {
+		ar, err := readahead.NewReaderSize(strings.NewReader("hello"), 8, size)
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		p := ar.(readahead.Reader)
+		got, err := p.Peek(3)
+		if err != nil || string(got) != "hel" {
+			t.Fatalf("size %d: want %q, <nil>, got %q, %v", size, "hel", got, err)
+		}
+		// Peek past the end of the input.
+		got, err = p.Peek(100)
+		if err != io.EOF || string(got) != "hello" {
+			t.Fatalf("size %d: want %q, EOF, got %q, %v", size, "hello", got, err)
+		}
+		got, err = p.Peek(5)
+		if err != nil || string(got) != "hello" {
+			t.Fatalf("size %d: want %q, <nil>, got %q, %v", size, "hello", got, err)
+		}
+		// Peek does not consume.
+		all, err := ioutil.ReadAll(ar)
+		if err != nil || string(all) != "hello" {
+			t.Fatalf("size %d: want %q, <nil>, got %q, %v", size, "hello", all, err)
+		}
+		got, err = p.Peek(1)
+		if err != io.EOF || len(got) != 0 {
+			t.Fatalf("size %d: want empty, EOF, got %q, %v", size, got, err)
+		}
+		ar.Close()
+	}
+
+	// Peeking further than the buffers allow.
+	input := strings.Repeat("0123456789", 10)
+	ar, err := readahead.NewReaderSize(strings.NewReader(input), 2, 10)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	got, err := ar.(readahead.Reader).Peek(50)
+	if err != bufio.ErrBufferFull || string(got) != input[:20] {
+		t.Fatalf("want %q, %v, got %q, %v", input[:20], bufio.ErrBufferFull, got, err)
+	}
+	all, err := ioutil.ReadAll(ar)
+	if err != nil || string(all) != input {
+		t.Fatalf("want %q, <nil>, got %q, %v", input, all, err)
+	}
+	ar.Close()
+}
+
+func TestReaderPeekError(t *testing.T) {
+	theErr := errors.New("some error")
+	for _, size := range []int{2, 3, 10} {
+		src := strings.NewReader("hello")
+		rd := dummyReader{readFN: func(dst []byte) (int, error) {
+			n, err := src.Read(dst)
+			if src.Len() == 0 {
+				err = theErr
+			}
+			return n, err
+		}}
+		ar, err := readahead.NewReaderSize(rd, 8, size)
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		p := ar.(readahead.Reader)
+		// The error is only returned when it is reached.
+		got, err := p.Peek(2)
+		if err != nil || string(got) != "he" {
+			t.Fatalf("size %d: want %q, <nil>, got %q, %v", size, "he", got, err)
+		}
+		got, err = p.Peek(10)
+		var rerr *readahead.ReadError
+		if !errors.As(err, &rerr) || rerr.Err != theErr || rerr.Offset != 5 || string(got) != "hello" {
+			t.Fatalf("size %d: want %q, ReadError at 5, got %q, %v", size, "hello", got, err)
+		}
+		all, err := ioutil.ReadAll(ar)
+		if !errors.As(err, &rerr) || rerr.Offset != 5 || string(all) != "hello" {
+			t.Fatalf("size %d: want %q, ReadError at 5, got %q, %v", size, "hello", all, err)
+		}
+		ar.Close()
+	}
+}
+
+func TestReaderReadError(t *testing.T) {
+	theErr := errors.New("some error")
+	newReader := func() io.Reader {
+		src := io.LimitReader(strings.NewReader(strings.Repeat("a", 1000)), 250)
+		return dummyReader{readFN: func(dst []byte) (int, error) {
+			n, err := src.Read(dst)
+			if err == io.EOF {
+				err = theErr
+			}
+			return n, err
+		}}
+	}
+	ar, err := readahead.NewReaderSize(newReader(), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	got, err := ioutil.ReadAll(ar)
+	var rerr *readahead.ReadError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("want ReadError, got %#v", err)
+	}
+	if rerr.Err != theErr || rerr.Offset != 250 || len(got) != 250 {
+		t.Fatalf("want error %v at 250, got %v at %d after %d bytes", theErr, rerr.Err, rerr.Offset, len(got))
+	}
+	ar.Close()
+
+	ar, err = readahead.NewReaderSize(newReader(), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	n, err := ar.(io.WriterTo).WriteTo(ioutil.Discard)
+	if !errors.As(err, &rerr) || rerr.Offset != n || n != 250 {
+		t.Fatalf("want ReadError at 250, got %v after %d bytes", err, n)
+	}
+	ar.Close()
+
+	// EOF is returned as is.
+	ar, err = readahead.NewReaderSize(strings.NewReader("abc"), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	_, err = ar.Read(make([]byte, 10))
+	if err != nil && err != io.EOF {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = ar.Read(make([]byte, 10)); err != io.EOF {
+		t.Fatalf("want %v, got %v", io.EOF, err)
+	}
+	ar.Close()
+}
+
+func TestReaderCloseDrain(t *testing.T) {
+	src := strings.NewReader(strings.Repeat("x", 1000))
+	closer := &testCloser{}
+	ar, err := readahead.NewReaderSize(src, 2, 100, readahead.WithCloser(closer))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if _, err := ar.Read(make([]byte, 10)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if err := ar.(readahead.Reader).CloseDrain(1000); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if src.Len() != 0 {
+		t.Fatalf("input not drained, %d bytes remain", src.Len())
+	}
+	if closer.closed != 1 {
+		t.Fatalf("want 1 close, got %d", closer.closed)
+	}
+
+	// Stop when the limit is reached.
+	src = strings.NewReader(strings.Repeat("x", 100000))
+	closer = &testCloser{}
+	ar, err = readahead.NewReaderSize(src, 2, 100, readahead.WithCloser(closer))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if err := ar.(readahead.Reader).CloseDrain(1000); err != readahead.ErrDrainLimit {
+		t.Fatalf("want %v, got %v", readahead.ErrDrainLimit, err)
+	}
+	if src.Len() == 0 {
+		t.Fatal("input was drained past the limit")
+	}
+	if closer.closed != 1 {
+		t.Fatalf("want 1 close, got %d", closer.closed)
+	}
+}
+
+type shortWriter struct {
+	bytes.Buffer
+}
+
+func (s *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:len(p)-1]
+	}
+	return s.Buffer.Write(p)
+}
+
+func TestReaderWriteToMulti(t *testing.T) {
+	input := make([]byte, 10000)
+	for i := range input {
+		input[i] = byte(i * 7 / 3)
+	}
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	var dst1, dst2 bytes.Buffer
+	n, err := ar.(readahead.Reader).WriteToMulti(&dst1, &dst2)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if n != int64(len(input)) {
+		t.Fatalf("want %d bytes, got %d", len(input), n)
+	}
+	if !bytes.Equal(dst1.Bytes(), input) || !bytes.Equal(dst2.Bytes(), input) {
+		t.Fatal("output mismatch")
+	}
+	ar.Close()
+
+	// A short write aborts, and the buffer is not consumed.
+	ar, err = readahead.NewReaderSize(bytes.NewReader(input), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	dst1.Reset()
+	n, err = ar.(readahead.Reader).WriteToMulti(&dst1, &shortWriter{})
+	if err != io.ErrShortWrite {
+		t.Fatalf("want %v, got %v", io.ErrShortWrite, err)
+	}
+	if n != 0 {
+		t.Fatalf("want 0 bytes, got %d", n)
+	}
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+	ar.Close()
+}
+
+func TestReaderZeroOnReuse(t *testing.T) {
+	bufs := [][]byte{make([]byte, 10)}
+	ar, err := readahead.NewReaderBuffer(strings.NewReader("0123456789ab"), bufs, readahead.WithZeroOnReuse())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	br := ar.(readahead.Reader)
+	if b, err := br.ReadBuffer(); err != nil || string(b) != "0123456789" {
+		t.Fatalf("want %q, <nil>, got %q, %v", "0123456789", b, err)
+	}
+	if b, err := br.ReadBuffer(); err != nil || string(b) != "ab" {
+		t.Fatalf("want %q, <nil>, got %q, %v", "ab", b, err)
+	}
+	// The buffer has been reused, and the tail must be cleared.
+	if want := "ab\x00\x00\x00\x00\x00\x00\x00\x00"; string(bufs[0]) != want {
+		t.Fatalf("want buffer %q, got %q", want, bufs[0])
+	}
+	if err := ar.Close(); err != nil {
+		t.Fatal("error when closing:", err)
+	}
+	if !bytes.Equal(bufs[0], make([]byte, 10)) {
+		t.Fatalf("buffer not cleared on Close: %q", bufs[0])
+	}
+
+	// Data read ahead is cleared when it is discarded by Seek and ResetSize.
+	sr, err := readahead.NewReaderBuffer(strings.NewReader("SECRETSECRETSECRET"), bufs, readahead.WithZeroOnReuse())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer sr.Close()
+	rd := sr.(readahead.SeekableReader)
+	if _, err := io.ReadFull(rd, make([]byte, 2)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if _, err := rd.Seek(17, io.SeekStart); err != nil {
+		t.Fatal("error when seeking:", err)
+	}
+	if b, err := rd.ReadBuffer(); err != nil || string(b) != "T" {
+		t.Fatalf("want %q, <nil>, got %q, %v", "T", b, err)
+	}
+	if want := "T\x00\x00\x00\x00\x00\x00\x00\x00\x00"; string(bufs[0]) != want {
+		t.Fatalf("want buffer %q after Seek, got %q", want, bufs[0])
+	}
+	if _, err := rd.Seek(0, io.SeekStart); err != nil {
+		t.Fatal("error when seeking:", err)
+	}
+	if _, err := io.ReadFull(rd, make([]byte, 2)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if err := rd.ResetSize(strings.NewReader("x"), 1, 10); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if b, err := rd.ReadBuffer(); err != nil || string(b) != "x" {
+		t.Fatalf("want %q, <nil>, got %q, %v", "x", b, err)
+	}
+	if want := "x\x00\x00\x00\x00\x00\x00\x00\x00\x00"; string(bufs[0]) != want {
+		t.Fatalf("want buffer %q after ResetSize, got %q", want, bufs[0])
+	}
+}
+
+func TestSeekerGrowingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "growing.log")
+	if err := ioutil.WriteFile(name, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar, err := readahead.NewReadSeekCloserSize(f, 4, 3)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	if pos, err := ar.Seek(0, io.SeekEnd); err != nil || pos != 5 {
+		t.Fatalf("want position 5, <nil>, got %d, %v", pos, err)
+	}
+
+	// Append to the file; the end must be queried again.
+	w, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteString(" world"); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if pos, err := ar.Seek(-5, io.SeekEnd); err != nil || pos != 6 {
+		t.Fatalf("want position 6, <nil>, got %d, %v", pos, err)
+	}
+	b, err := ioutil.ReadAll(ar)
+	if err != nil || string(b) != "world" {
+		t.Fatalf("want %q, <nil>, got %q, %v", "world", b, err)
+	}
+
+	// Seeking from the current position accounts for read ahead data.
+	if _, err := ar.Seek(0, io.SeekStart); err != nil {
+		t.Fatal("error when seeking:", err)
+	}
+	if _, err := io.ReadFull(ar, make([]byte, 2)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if pos, err := ar.Seek(0, io.SeekCurrent); err != nil || pos != 2 {
+		t.Fatalf("want position 2, <nil>, got %d, %v", pos, err)
+	}
+}
+
+func TestReaderReadN(t *testing.T) {
+	ar, err := readahead.NewReaderSize(strings.NewReader("0123456789abc"), 4, 3)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	rn := ar.(readahead.Reader)
+	for _, want := range []string{"01", "23456", "", "789a"} {
+		got, err := rn.ReadN(len(want))
+		if err != nil || string(got) != want {
+			t.Fatalf("want %q, <nil>, got %q, %v", want, got, err)
+		}
+	}
+	got, err := rn.ReadN(10)
+	if err != io.ErrUnexpectedEOF || string(got) != "bc" {
+		t.Fatalf("want %q, %v, got %q, %v", "bc", io.ErrUnexpectedEOF, got, err)
+	}
+	got, err = rn.ReadN(10)
+	if err != io.EOF || len(got) != 0 {
+		t.Fatalf("want empty, %v, got %q, %v", io.EOF, got, err)
+	}
+	if _, err := rn.ReadN(-1); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestReaderResetSize(t *testing.T) {
+	buf := make([]byte, 100)
+	ar, err := readahead.NewReaderBuffer(strings.NewReader("first input"), [][]byte{buf})
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if b, err := ioutil.ReadAll(ar); err != nil || string(b) != "first input" {
+		t.Fatalf("want %q, <nil>, got %q, %v", "first input", b, err)
+	}
+	ar.Close()
+
+	// A smaller size reuses the buffer.
+	rs := ar.(readahead.Reader)
+	if err := rs.ResetSize(strings.NewReader("xyz"), 1, 50); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if b, err := ioutil.ReadAll(ar); err != nil || string(b) != "xyz" {
+		t.Fatalf("want %q, <nil>, got %q, %v", "xyz", b, err)
+	}
+	if string(buf[:3]) != "xyz" {
+		t.Fatalf("buffer was not reused, got %q", buf[:3])
+	}
+
+	// A bigger size allocates, without closing first.
+	input := strings.Repeat("0123456789", 100)
+	if err := rs.ResetSize(strings.NewReader(input), 4, 200); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if off := ar.(readahead.Reader).Offset(); off != 0 {
+		t.Fatalf("want offset 0, got %d", off)
+	}
+	if b, err := ioutil.ReadAll(ar); err != nil || string(b) != input {
+		t.Fatalf("want %q, <nil>, got %q, %v", input, b, err)
+	}
+	if string(buf[:3]) != "xyz" {
+		t.Fatalf("buffer was reused, got %q", buf[:3])
+	}
+	if err := ar.Close(); err != nil {
+		t.Fatal("error when closing:", err)
+	}
+
+	if err := rs.ResetSize(nil, 4, 200); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestReaderBufferedFree(t *testing.T) {
+	ar, err := readahead.NewReaderSize(strings.NewReader(strings.Repeat("x", 250)), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	bf := ar.(readahead.Reader)
+	if err := bf.WaitSaturated(context.Background()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	// The error is seen before the final buffer is handed over.
+	waitFor(t, "250 bytes to be buffered", func() bool { return bf.Buffered() == 250 })
+	if n := bf.Free(); n != 150 {
+		t.Fatalf("want 150 free, got %d", n)
+	}
+	if _, err := io.ReadFull(ar, make([]byte, 120)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if n := bf.Buffered(); n != 130 {
+		t.Fatalf("want 130 buffered, got %d", n)
+	}
+	if n := bf.Free(); n != 270 {
+		t.Fatalf("want 270 free, got %d", n)
+	}
+}
+
+// readingConn signals reading when Read is called.
+type readingConn struct {
+	net.Conn
+	reading chan struct{}
+}
+
+func (c *readingConn) Read(p []byte) (int, error) {
+	select {
+	case c.reading <- struct{}{}:
+	default:
+	}
+	return c.Conn.Read(p)
+}
+
+func TestReaderConnUnblock(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := &readingConn{Conn: c1, reading: make(chan struct{}, 1)}
+	ar, err := readahead.NewReaderSize(conn, 4, 100, readahead.WithConnUnblock())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	// Make sure the async reader is waiting for data.
+	<-conn.reading
+	closed := make(chan error)
+	go func() {
+		closed <- ar.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal("error when closing:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	c1.Close()
+}
+
+func TestReaderTotalTimeout(t *testing.T) {
+	slow := func() io.Reader {
+		return dummyReader{readFN: func(dst []byte) (int, error) {
+			time.Sleep(2 * time.Millisecond)
+			return 1, nil
+		}}
+	}
+	ar, err := readahead.NewReaderSize(slow(), 4, 10, readahead.WithTotalTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	start := time.Now()
+	_, err = io.Copy(ioutil.Discard, iotest.OneByteReader(ar))
+	if err != readahead.ErrTotalTimeout {
+		t.Fatalf("want %v, got %v", readahead.ErrTotalTimeout, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("timeout took %v", d)
+	}
+	// Sticky.
+	if _, err := ar.Read(make([]byte, 1)); err != readahead.ErrTotalTimeout {
+		t.Fatalf("want %v, got %v", readahead.ErrTotalTimeout, err)
+	}
+	ar.Close()
+
+	ar, err = readahead.NewReaderSize(slow(), 4, 10, readahead.WithTotalTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if _, err = ar.(io.WriterTo).WriteTo(ioutil.Discard); err != readahead.ErrTotalTimeout {
+		t.Fatalf("want %v, got %v", readahead.ErrTotalTimeout, err)
+	}
+	ar.Close()
+
+	if _, err := readahead.NewReaderSize(slow(), 4, 10, readahead.WithTotalTimeout(0)); err == nil {
+		t.Fatal("expected error when creating, but got nil")
+	}
+}
+
+func TestReaderReadAtLeast(t *testing.T) {
+	ar, err := readahead.NewReaderSize(strings.NewReader("0123456789abc"), 4, 3)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	rl := ar.(readahead.Reader)
+	if _, err := rl.ReadAtLeast(make([]byte, 2), 3); err != io.ErrShortBuffer {
+		t.Fatalf("want %v, got %v", io.ErrShortBuffer, err)
+	}
+	p := make([]byte, 10)
+	n, err := rl.ReadAtLeast(p, 5)
+	if err != nil || n < 5 || string(p[:n]) != "0123456789"[:n] {
+		t.Fatalf("want at least %q, <nil>, got %q, %v", "01234", p[:n], err)
+	}
+	rest := "0123456789abc"[n:]
+	n, err = rl.ReadAtLeast(make([]byte, 20), 20)
+	if err != io.ErrUnexpectedEOF || n != len(rest) {
+		t.Fatalf("want %d, %v, got %d, %v", len(rest), io.ErrUnexpectedEOF, n, err)
+	}
+	n, err = rl.ReadAtLeast(make([]byte, 20), 1)
+	if err != io.EOF || n != 0 {
+		t.Fatalf("want 0, %v, got %d, %v", io.EOF, n, err)
+	}
+}
+
+func TestSetDefaults(t *testing.T) {
+	if err := readahead.SetDefaults(2, 100); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer readahead.SetDefaults(readahead.DefaultBuffers, readahead.DefaultBufferSize)
+	ar := readahead.NewReader(strings.NewReader(""))
+	bf := ar.(readahead.Reader)
+	if n := bf.Buffered() + bf.Free(); n != 200 {
+		t.Fatalf("want capacity 200, got %d", n)
+	}
+	ar.Close()
+
+	if err := readahead.SetDefaults(0, 100); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if err := readahead.SetDefaults(2, 0); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestWriteToFailFast(t *testing.T) {
+	theErr := errors.New("some error")
+	newInput := func() io.Reader {
+		var n int
+		return dummyReader{readFN: func(dst []byte) (int, error) {
+			if n == 3 {
+				n++
+				return 0, theErr
+			}
+			n++
+			return len(dst), nil
+		}}
+	}
+	for _, failFast := range []bool{false, true} {
+		var opts []readahead.Option
+		if failFast {
+			opts = append(opts, readahead.WithFailFast())
+		}
+		ar, err := readahead.NewReaderSize(newInput(), 4, 100, opts...)
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		if err := ar.(readahead.Reader).WaitSaturated(context.Background()); !errors.Is(err, theErr) {
+			t.Fatalf("fail fast %v: want %v, got %v", failFast, theErr, err)
+		}
+		var w countingWriter
+		n, err := ar.(io.WriterTo).WriteTo(&w)
+		if !errors.Is(err, theErr) {
+			t.Fatalf("fail fast %v: want %v, got %v", failFast, theErr, err)
+		}
+		want := int64(300)
+		if failFast {
+			want = 0
+		}
+		if n != want || int64(w.Len()) != n {
+			t.Fatalf("fail fast %v: want %d bytes written, got %d (%d)", failFast, want, n, w.Len())
+		}
+		ar.Close()
+	}
+}
+
+func TestReaderNextSize(t *testing.T) {
+	ar, err := readahead.NewReaderSize(strings.NewReader(strings.Repeat("x", 250)), 4, 100, readahead.WithLazyStart())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	ns := ar.(readahead.Reader)
+	if n, ok := ns.NextSize(); ok || n != 0 {
+		t.Fatalf("want 0, false, got %d, %v", n, ok)
+	}
+	if err := ns.WaitSaturated(context.Background()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	// The end of the input is seen before the final buffer is handed over.
+	waitFor(t, "all data to be read ahead", func() bool { return len(ns.PeekAvailable()) == 250 })
+	for _, want := range []int{100, 100, 50} {
+		n, ok := ns.NextSize()
+		if !ok || n != want {
+			t.Fatalf("want %d, true, got %d, %v", want, n, ok)
+		}
+		b, err := ns.ReadBuffer()
+		if err != nil && err != io.EOF {
+			t.Fatal("error when reading:", err)
+		}
+		if len(b) != want {
+			t.Fatalf("want %d bytes, got %d", want, len(b))
+		}
+	}
+	if n, ok := ns.NextSize(); ok || n != 0 {
+		t.Fatalf("want 0, false, got %d, %v", n, ok)
+	}
+}
+
+func TestReaderHash(t *testing.T) {
+	input := make([]byte, 10000)
+	for i := range input {
+		input[i] = byte(i * 7 / 3)
+	}
+	h := sha256.New()
+	ar, err := readahead.NewReadSeekerSize(bytes.NewReader(input), 4, 100, readahead.WithHash(h))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	if _, err := ar.(io.WriterTo).WriteTo(ioutil.Discard); err != nil {
+		t.Fatal("error when writing:", err)
+	}
+	if want := sha256.Sum256(input); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Fatal("hash mismatch")
+	}
+
+	// Seeking resets the hash.
+	if _, err := ar.Seek(5000, io.SeekStart); err != nil {
+		t.Fatal("error when seeking:", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, iotest.OneByteReader(ar)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if want := sha256.Sum256(input[5000:]); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Fatal("hash mismatch after seek")
+	}
+
+	// Also when seeking to the current position.
+	if _, err := ar.Seek(9000, io.SeekStart); err != nil {
+		t.Fatal("error when seeking:", err)
+	}
+	if _, err := io.ReadFull(ar, make([]byte, 100)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if _, err := ar.Seek(0, io.SeekCurrent); err != nil {
+		t.Fatal("error when seeking:", err)
+	}
+	if _, err := ioutil.ReadAll(ar); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if want := sha256.Sum256(input[9100:]); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Fatal("hash mismatch after seek to current position")
+	}
+
+	// Manual reset.
+	if _, err := ar.Seek(0, io.SeekStart); err != nil {
+		t.Fatal("error when seeking:", err)
+	}
+	if _, err := io.ReadFull(ar, make([]byte, 100)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	ar.(readahead.Reader).ResetHash()
+	if _, err := ioutil.ReadAll(ar); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if want := sha256.Sum256(input[100:]); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Fatal("hash mismatch after reset")
+	}
+}
+
+func TestReaderKernelReadahead(t *testing.T) {
+	input := make([]byte, 100000)
+	for i := range input {
+		input[i] = byte(i * 7 / 3)
+	}
+	name := filepath.Join(t.TempDir(), "input")
+	if err := ioutil.WriteFile(name, input, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar, err := readahead.NewReadSeekCloserSize(f, 4, 1000, readahead.WithKernelReadahead())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+	if _, err := ar.Seek(50000, io.SeekStart); err != nil {
+		t.Fatal("error when seeking:", err)
+	}
+	got, err = ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(got, input[50000:]) {
+		t.Fatal("output mismatch after seek")
+	}
+}
+
+func BenchmarkReadFile(b *testing.B) {
+	name := filepath.Join(b.TempDir(), "input")
+	if err := ioutil.WriteFile(name, make([]byte, 32<<20), 0644); err != nil {
+		b.Fatal(err)
+	}
+	bench := func(b *testing.B, opts ...readahead.Option) {
+		b.SetBytes(32 << 20)
+		for i := 0; i < b.N; i++ {
+			f, err := os.Open(name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ar, err := readahead.NewReadSeekCloserSize(f, 4, 1<<20, opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(ioutil.Discard, ar); err != nil {
+				b.Fatal(err)
+			}
+			ar.Close()
+		}
+	}
+	b.Run("default", func(b *testing.B) { bench(b) })
+	b.Run("kernel", func(b *testing.B) { bench(b, readahead.WithKernelReadahead()) })
+}
+
+func BenchmarkSmallInput(b *testing.B) {
+	for _, size := range []int{100, 1 << 10, 4 << 10} {
+		input := make([]byte, size)
+		bufs := make([][]byte, 4)
+		for i := range bufs {
+			bufs[i] = make([]byte, 64<<10)
+		}
+		bench := func(b *testing.B, opts ...readahead.Option) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				ar, err := readahead.NewReaderBuffer(bytes.NewReader(input), bufs, opts...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(ioutil.Discard, ar); err != nil {
+					b.Fatal(err)
+				}
+				ar.Close()
+			}
+		}
+		b.Run(fmt.Sprintf("%d/default", size), func(b *testing.B) { bench(b) })
+		b.Run(fmt.Sprintf("%d/lazy", size), func(b *testing.B) { bench(b, readahead.WithLazyStart()) })
+	}
+}
+
+func TestReaderLazyStartSmallInput(t *testing.T) {
+	var calls int
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		calls++
+		if calls > 1 {
+			t.Error("read after EOF")
+		}
+		return copy(dst, "small input"), io.EOF
+	}}
+	ar, err := readahead.NewReaderSize(&r, 4, 1000, readahead.WithLazyStart())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "small input" {
+		t.Fatalf("got %q", got)
+	}
+	n, err := ar.Read(make([]byte, 10))
+	if n != 0 || err != io.EOF {
+		t.Fatalf("want 0, io.EOF, got %d, %v", n, err)
+	}
+}
+
+func TestReaderLazyStartNoGoroutine(t *testing.T) {
+	// Other goroutines may be started meanwhile, so only fail
+	// if a goroutine is started every time.
+	buf := make([]byte, 10)
+	started := 0
+	for i := 0; i < 10; i++ {
+		before := runtime.NumGoroutine()
+		ar, err := readahead.NewReaderSize(strings.NewReader("small"), 4, 1000, readahead.WithLazyStart())
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := ar.Read(buf)
+		if runtime.NumGoroutine() > before {
+			started++
+		}
+		if n != 5 || err != nil {
+			t.Fatalf("want 5, nil, got %d, %v", n, err)
+		}
+		if _, err := ar.Read(buf); err != io.EOF {
+			t.Fatal("want io.EOF, got", err)
+		}
+		ar.Close()
+	}
+	if started == 10 {
+		t.Fatal("goroutine started for small input")
+	}
+}
+
+func TestReaderLazyStartContext(t *testing.T) {
+	block := make(chan struct{})
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		<-block
+		return 0, io.EOF
+	}}
+	ar, err := readahead.NewReaderSize(r, 4, 1000, readahead.WithLazyStart())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		close(block)
+		ar.Close()
+	}()
+	// The input is blocked, so the first buffer must be waited for asynchronously.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := ar.(readahead.Reader).WriteToContext(ctx, ioutil.Discard)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Fatal("want", context.DeadlineExceeded, "got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteToContext did not return when ctx expired")
+	}
+}
+
+func TestReaderBlockedInput(t *testing.T) {
+	block := make(chan struct{})
+	var calls int
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		calls++
+		if calls > 2 {
+			// Block until the test is done.
+			<-block
+			return 0, io.EOF
+		}
+		for i := range dst {
+			dst[i] = byte(calls)
+		}
+		return len(dst), nil
+	}}
+	ar, err := readahead.NewReaderSize(r, 2, 10)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	done := make(chan error)
+	go func() {
+		// Both filled buffers must be returned while the input is blocked.
+		_, err := io.ReadFull(ar, make([]byte, 20))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("error when reading:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read blocked while data was available")
+	}
+	close(block)
+	ar.Close()
+}
+
+// blockingContextReader returns data, then blocks until the context is done.
+type blockingContextReader struct {
+	data []byte
+}
+
+func (b *blockingContextReader) ReadContext(ctx context.Context, p []byte) (int, error) {
+	if len(b.data) > 0 {
+		n := copy(p, b.data)
+		b.data = b.data[n:]
+		return n, nil
+	}
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestContextSourceReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ar, err := readahead.NewContextSourceReader(&blockingContextReader{data: []byte("hello")}, ctx, 4, 5)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(ar, got); err != nil || string(got) != "hello" {
+		t.Fatalf("want %q, <nil>, got %q, %v", "hello", got, err)
+	}
+	// Cancelling the context is returned from the input.
+	cancel()
+	if _, err := ar.Read(got); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v, got %v", context.Canceled, err)
+	}
+	ar.Close()
+
+	// Close unblocks the input.
+	ar, err = readahead.NewContextSourceReader(&blockingContextReader{}, context.Background(), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	closed := make(chan error)
+	go func() {
+		closed <- ar.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal("error when closing:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+}
+
+func TestReaderEOFCoupling(t *testing.T) {
+	for _, size := range []int{3, 5, 100} {
+		ar, err := readahead.NewReaderSize(strings.NewReader("hello"), 4, size, readahead.WithEOFCoupling())
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		// Wait for the end of the input to be handed over.
+		if b, err := ar.(readahead.Reader).Peek(6); err != io.EOF || string(b) != "hello" {
+			t.Fatalf("size %d: want %q, EOF, got %q, %v", size, "hello", b, err)
+		}
+		var got []byte
+		var err2 error
+		for err2 == nil {
+			p := make([]byte, 100)
+			var n int
+			n, err2 = ar.Read(p)
+			got = append(got, p[:n]...)
+			if err2 == nil && n == 0 {
+				t.Fatal("no progress")
+			}
+			if err2 == io.EOF && n == 0 {
+				t.Fatalf("size %d: io.EOF was not returned with the data", size)
+			}
+		}
+		if err2 != io.EOF || string(got) != "hello" {
+			t.Fatalf("size %d: want %q, EOF, got %q, %v", size, "hello", got, err2)
+		}
+		ar.Close()
+	}
+
+	// Default is to return io.EOF separately.
+	ar, err := readahead.NewReaderSize(strings.NewReader("hello"), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	if n, err := ar.Read(make([]byte, 100)); n != 5 || err != nil {
+		t.Fatalf("want 5, <nil>, got %d, %v", n, err)
+	}
+	if n, err := ar.Read(make([]byte, 100)); n != 0 || err != io.EOF {
+		t.Fatalf("want 0, EOF, got %d, %v", n, err)
+	}
+}
+
+func TestReaderForEachBuffer(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 64)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	var got []byte
+	err = ar.(readahead.Reader).ForEachBuffer(context.Background(), func(b []byte) error {
+		if len(b) > 64 {
+			t.Errorf("buffer of %d bytes", len(b))
+		}
+		got = append(got, b...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+	ar.Close()
+
+	// An error from the callback stops iteration.
+	ar, err = readahead.NewReaderSize(bytes.NewReader(input), 4, 64)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	theErr := errors.New("stop")
+	calls := 0
+	err = ar.(readahead.Reader).ForEachBuffer(context.Background(), func(b []byte) error {
+		calls++
+		return theErr
+	})
+	if err != theErr || calls != 1 {
+		t.Fatalf("want %v after 1 call, got %v after %d", theErr, err, calls)
+	}
+	// The remaining data can still be read.
+	rest, err := ioutil.ReadAll(ar)
+	if err != nil || !bytes.Equal(rest, input[64:]) {
+		t.Fatalf("unexpected remaining data, error: %v", err)
+	}
+	ar.Close()
+
+	// Cancelled context.
+	ar, err = readahead.NewReaderSize(bytes.NewReader(input), 4, 64)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ar.(readahead.Reader).ForEachBuffer(ctx, func(b []byte) error { return nil }); err != context.Canceled {
+		t.Fatalf("want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestReaderSetPrefetchFactor(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	var reads int32
+	src := bytes.NewReader(input)
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		atomic.AddInt32(&reads, 1)
+		return src.Read(dst)
+	}}
+	ar, err := readahead.NewReaderSize(r, 4, 10, readahead.WithLazyStart())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	pf := ar.(readahead.Reader)
+	for _, f := range []float64{-0.1, 1.1, math.NaN()} {
+		if err := pf.SetPrefetchFactor(f); err == nil {
+			t.Errorf("factor %v: expected error", f)
+		}
+	}
+	if err := pf.SetPrefetchFactor(0); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := io.ReadFull(ar, make([]byte, 10))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatal("read returned while paused:", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := atomic.LoadInt32(&reads); n != 0 {
+		t.Fatalf("input read %d times while paused", n)
+	}
+
+	// With half the buffers, the first buffer is returned
+	// and at most 2 more are read ahead.
+	if err := pf.SetPrefetchFactor(0.5); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	waitFor(t, "3 reads", func() bool { return atomic.LoadInt32(&reads) >= 3 })
+	if n := atomic.LoadInt32(&reads); n != 3 {
+		t.Fatalf("want 3 reads, got %d", n)
+	}
+
+	if err := pf.SetPrefetchFactor(1); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(got, input[10:]) {
+		t.Fatal("output mismatch")
+	}
+}
+
+func TestReaderNoCoalesce(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 10))
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 7, readahead.WithNoCoalesce())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	// Wait for all buffers to be filled, so data from several buffers is available.
+	if err := ar.(readahead.Reader).WaitSaturated(context.Background()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	var got []byte
+	dst := make([]byte, 100)
+	for {
+		n, err := ar.Read(dst)
+		got = append(got, dst[:n]...)
+		// Every buffer is filled completely, except the last.
+		if n != 7 && len(got) != len(input) {
+			t.Fatalf("read returned %d bytes at offset %d", n, len(got)-n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("error when reading:", err)
+		}
+	}
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+
+	conflicts := [][]readahead.Option{
+		{readahead.WithNoCoalesce(), readahead.WithRecordSize(4)},
+		{readahead.WithRecordSize(4), readahead.WithNoCoalesce()},
+		{readahead.WithNoCoalesce(), readahead.WithWriteCoalesce(100)},
+		{readahead.WithWriteCoalesce(100), readahead.WithNoCoalesce()},
+	}
+	for i, opts := range conflicts {
+		ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 7, opts...)
+		if err == nil {
+			ar.Close()
+			t.Errorf("options %d: expected error", i)
+		}
+	}
+}
+
+func TestReaderClone(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	ar, err := readahead.NewReadSeekerSize(bytes.NewReader(input), 4, 32)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	if _, err := io.ReadFull(ar, make([]byte, 45)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	clone, err := ar.(readahead.Reader).Clone()
+	if err != nil {
+		t.Fatal("error when cloning:", err)
+	}
+	if pos, err := clone.Seek(0, io.SeekCurrent); err != nil || pos != 45 {
+		t.Fatalf("want position 45, got %d, error: %v", pos, err)
+	}
+	// Read both concurrently.
+	var wg sync.WaitGroup
+	for _, r := range []io.Reader{ar, clone} {
+		wg.Add(1)
+		go func(r io.Reader) {
+			defer wg.Done()
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Error("error when reading:", err)
+			}
+			if !bytes.Equal(got, input[45:]) {
+				t.Error("output mismatch")
+			}
+		}(r)
+	}
+	wg.Wait()
+	if err := clone.Close(); err != nil {
+		t.Fatal("error when closing:", err)
+	}
+	// The original can still seek after the clone is closed.
+	if _, err := ar.Seek(10, io.SeekStart); err != nil {
+		t.Fatal("error when seeking:", err)
+	}
+	if b, err := ioutil.ReadAll(ar); err != nil || !bytes.Equal(b, input[10:]) {
+		t.Fatalf("output mismatch, error: %v", err)
+	}
+
+	// From NewReaderAt.
+	ra, err := readahead.NewReaderAt(bytes.NewReader(input), 4, 32)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ra.Close()
+	io.ReadFull(ra, make([]byte, 100))
+	clone, err = ra.(readahead.Reader).Clone()
+	if err != nil {
+		t.Fatal("error when cloning:", err)
+	}
+	if b, err := ioutil.ReadAll(clone); err != nil || !bytes.Equal(b, input[100:]) {
+		t.Fatalf("output mismatch, error: %v", err)
+	}
+	clone.Close()
+
+	// Not seekable.
+	nr, err := readahead.NewReaderSize(bytes.NewBuffer(input), 4, 32)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer nr.Close()
+	if _, err := nr.(readahead.Reader).Clone(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestReaderEOFOnEmptyRead(t *testing.T) {
+	src := strings.NewReader("Testbuffer")
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		if len(dst) > 3 {
+			dst = dst[:3]
+		}
+		n, _ := src.Read(dst)
+		// Never returns io.EOF.
+		return n, nil
+	}}
+	ar, err := readahead.NewReaderSize(r, 4, 5, readahead.WithEOFOnEmptyRead())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if string(got) != "Testbuffer" {
+		t.Fatalf("want %q, got %q", "Testbuffer", got)
+	}
+	if n, err := ar.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Fatalf("want (0, io.EOF), got (%d, %v)", n, err)
+	}
+}
+
+func TestReaderWriteToN(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 64)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	var got []byte
+	for _, n := range []int64{0, 10, 100, 54, 1} {
+		dst := &bytes.Buffer{}
+		written, err := ar.(readahead.Reader).WriteToN(dst, n)
+		if err != nil {
+			t.Fatal("error when writing:", err)
+		}
+		if written != n || int64(dst.Len()) != n {
+			t.Fatalf("want %d bytes, wrote %d, got %d", n, written, dst.Len())
+		}
+		got = append(got, dst.Bytes()...)
+	}
+	// The remaining data is available to Read.
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(ar, b); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	got = append(got, b...)
+	// Ask for more than remains.
+	dst := &bytes.Buffer{}
+	written, err := ar.(readahead.Reader).WriteToN(dst, 10000)
+	if err != io.EOF {
+		t.Fatal("want io.EOF, got", err)
+	}
+	if written != int64(len(input)-len(got)) {
+		t.Fatalf("want %d bytes, got %d", len(input)-len(got), written)
+	}
+	got = append(got, dst.Bytes()...)
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+}
+
+func TestReaderIdle(t *testing.T) {
+	pr, pw := io.Pipe()
+	ar, err := readahead.NewReaderSize(pr, 4, 10)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer func() {
+		// Unblock the input before closing.
+		pw.Close()
+		ar.Close()
+	}()
+	waitIdle := func(want int) {
+		t.Helper()
+		waitFor(t, fmt.Sprint(want, " idle buffers"), func() bool { return ar.(readahead.Reader).Idle() == want })
+	}
+	// One buffer is being filled.
+	waitIdle(3)
+	pw.Write([]byte(strings.Repeat("x", 20)))
+	// Two buffers are waiting for the consumer.
+	waitIdle(1)
+	if _, err := io.ReadFull(ar, make([]byte, 10)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	waitIdle(2)
+}
+
+// readPosRecorder records the position of the first read.
+type readPosRecorder struct {
+	*bytes.Reader
+	first int64
+	read  bool
+}
+
+func (r *readPosRecorder) Read(p []byte) (int, error) {
+	if !r.read {
+		r.read = true
+		r.first = r.Size() - int64(r.Len())
+	}
+	return r.Reader.Read(p)
+}
+
+func TestNewReadSeekerAt(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	src := &readPosRecorder{Reader: bytes.NewReader(input)}
+	ar, err := readahead.NewReadSeekerAt(src, 555, 4, 32)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(got, input[555:]) {
+		t.Fatal("output mismatch")
+	}
+	if src.first != 555 {
+		t.Fatalf("first read at %d, want 555", src.first)
+	}
+	if off := ar.(readahead.Reader).Offset(); off != int64(len(input)) {
+		t.Fatalf("want offset %d, got %d", len(input), off)
+	}
+
+	if _, err := readahead.NewReadSeekerAt(bytes.NewReader(input), -1, 4, 32); err == nil {
+		t.Fatal("expected error for negative offset")
+	}
+}
+
+func TestReaderWithRawReader(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 10))
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 2, 10)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	rr := ar.(readahead.Reader)
+	if _, err := io.ReadFull(ar, make([]byte, 5)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if err := rr.WaitSaturated(context.Background()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	var buffered int
+	err = rr.WithRawReader(func(in io.Reader) error {
+		buffered = rr.Buffered()
+		br := in.(*bytes.Reader)
+		// The input is positioned after the data read ahead.
+		if pos := br.Size() - int64(br.Len()); pos != int64(5+buffered) {
+			t.Errorf("input at %d, want %d", pos, 5+buffered)
+		}
+		_, err := in.Read(make([]byte, 3))
+		return err
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	// The 3 bytes read by fn are skipped.
+	want := append(append([]byte{}, input[5:5+buffered]...), input[5+buffered+3:]...)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+
+	theErr := errors.New("my error")
+	if err := rr.WithRawReader(func(io.Reader) error { return theErr }); err != theErr {
+		t.Fatal("want", theErr, "got", err)
+	}
+}
+
+func TestReaderEmptyInput(t *testing.T) {
+	for _, opts := range [][]readahead.Option{nil, {readahead.WithLazyBuffers()}, {readahead.WithLazyStart()}} {
+		ar, err := readahead.NewReaderSize(strings.NewReader(""), 4, 100, opts...)
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 3; i++ {
+				n, err := ar.Read(make([]byte, 10))
+				if n != 0 || err != io.EOF {
+					t.Errorf("read %d: want (0, io.EOF), got (%d, %v)", i, n, err)
+				}
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("read did not return")
+		}
+		ar.Close()
+
+		ar, err = readahead.NewReaderSize(strings.NewReader(""), 4, 100, opts...)
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		n, err := ar.(io.WriterTo).WriteTo(ioutil.Discard)
+		if n != 0 || err != nil {
+			t.Errorf("WriteTo: want (0, nil), got (%d, %v)", n, err)
+		}
+		ar.Close()
+	}
+}
+
+func TestReaderThreadLock(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	ar, err := readahead.NewReadSeekerSize(bytes.NewReader(input), 4, 64, readahead.WithThreadLock())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	if _, err := io.ReadFull(ar, make([]byte, 100)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	// Restarts the async reader.
+	if _, err := ar.Seek(500, io.SeekStart); err != nil {
+		t.Fatal("error when seeking:", err)
+	}
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(got, input[500:]) {
+		t.Fatal("output mismatch")
+	}
+}
+
+func TestReaderPrefault(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 10000))
+	for _, lazy := range []bool{false, true} {
+		opts := []readahead.Option{readahead.WithPrefault()}
+		if lazy {
+			opts = append(opts, readahead.WithLazyBuffers())
+		}
+		ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 10000, opts...)
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		got, err := ioutil.ReadAll(ar)
+		if err != nil {
+			t.Fatal("error when reading:", err)
+		}
+		if !bytes.Equal(got, input) {
+			t.Fatal("output mismatch")
+		}
+		ar.Close()
+	}
+}
+
+func TestReaderInvalidReadCount(t *testing.T) {
+	// Negative counts are returned as is, positive counts are added to the size of the read.
+	for _, bad := range []int{-1, 1} {
+		src := strings.NewReader(strings.Repeat("x", 25))
+		reads := 0
+		r := dummyReader{readFN: func(dst []byte) (int, error) {
+			reads++
+			if reads == 2 {
+				if bad < 0 {
+					return bad, nil
+				}
+				return len(dst) + bad, nil
+			}
+			if len(dst) > 10 {
+				dst = dst[:10]
+			}
+			return src.Read(dst)
+		}}
+		ar, err := readahead.NewReaderSize(r, 4, 100)
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		got, err := ioutil.ReadAll(ar)
+		if err == nil || !strings.Contains(err.Error(), "invalid count") {
+			t.Fatalf("count %+d: want invalid count error, got %v", bad, err)
+		}
+		// Data before the invalid read is returned.
+		if len(got) != 10 {
+			t.Fatalf("count %+d: want 10 bytes, got %d", bad, len(got))
+		}
+		ar.Close()
+	}
+}
+
+func TestReaderDrainToEOF(t *testing.T) {
+	ar, err := readahead.NewReaderSize(strings.NewReader(strings.Repeat("x", 1000)), 4, 64)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	if _, err := io.ReadFull(ar, make([]byte, 10)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	n, err := ar.(readahead.Reader).DrainToEOF()
+	if n != 990 || err != nil {
+		t.Fatalf("want (990, nil), got (%d, %v)", n, err)
+	}
+	if n, err := ar.(readahead.Reader).DrainToEOF(); n != 0 || err != nil {
+		t.Fatalf("want (0, nil), got (%d, %v)", n, err)
+	}
+
+	theErr := errors.New("my error")
+	src := strings.NewReader(strings.Repeat("x", 100))
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		n, _ := src.Read(dst)
+		if n == 0 {
+			return 0, theErr
+		}
+		return n, nil
+	}}
+	ar2, err := readahead.NewReaderSize(r, 4, 64)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar2.Close()
+	n, err = ar2.(readahead.Reader).DrainToEOF()
+	if n != 100 || !errors.Is(err, theErr) {
+		t.Fatalf("want (100, %v), got (%d, %v)", theErr, n, err)
+	}
+}
+
+func TestReaderReadUntil(t *testing.T) {
+	input := "first\nsecond line spans buffers\n\nlast"
+	ar, err := readahead.NewReaderSize(strings.NewReader(input), 4, 4)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	ur := ar.(readahead.Reader)
+	for _, want := range []string{"first\n", "second line spans buffers\n", "\n"} {
+		got, err := ur.ReadUntil('\n')
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if string(got) != want {
+			t.Fatalf("want %q, got %q", want, got)
+		}
+	}
+	got, err := ur.ReadUntil('\n')
+	if string(got) != "last" || err != io.EOF {
+		t.Fatalf("want (%q, io.EOF), got (%q, %v)", "last", got, err)
+	}
+	if got, err := ur.ReadUntil('\n'); len(got) != 0 || err != io.EOF {
+		t.Fatalf("want (\"\", io.EOF), got (%q, %v)", got, err)
+	}
+
+	// With a limit.
+	ar2, err := readahead.NewReaderSize(strings.NewReader(input), 4, 4)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar2.Close()
+	ur = ar2.(readahead.Reader)
+	if got, err := ur.ReadUntilLimit('\n', 6); string(got) != "first\n" || err != nil {
+		t.Fatalf("want (%q, nil), got (%q, %v)", "first\n", got, err)
+	}
+	if got, err := ur.ReadUntilLimit('\n', 10); string(got) != "second lin" || err != readahead.ErrTokenTooLong {
+		t.Fatalf("want (%q, %v), got (%q, %v)", "second lin", readahead.ErrTokenTooLong, got, err)
+	}
+	// Continues after the returned data.
+	if got, err := ur.ReadUntil('\n'); string(got) != "e spans buffers\n" || err != nil {
+		t.Fatalf("want (%q, nil), got (%q, %v)", "e spans buffers\n", got, err)
+	}
+}
+
+func TestReaderReleaseFunc(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	bufs := make([][]byte, 4)
+	for i := range bufs {
+		bufs[i] = make([]byte, 64)
+	}
+	var mu sync.Mutex
+	released := map[*byte]int{}
+	release := func(buf []byte) {
+		mu.Lock()
+		released[&buf[:1][0]]++
+		mu.Unlock()
+	}
+	ar, err := readahead.NewReaderBuffer(bytes.NewReader(input), bufs, readahead.WithReleaseFunc(release))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if _, err := io.ReadFull(ar, make([]byte, 100)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	// Drops 2 buffers.
+	if err := ar.(readahead.Reader).Resize(2, 64); err != nil {
+		t.Fatal("error when resizing:", err)
+	}
+	// Drops the remaining buffers and allocates 2 new ones.
+	if err := ar.(readahead.Reader).Resize(2, 32); err != nil {
+		t.Fatal("error when resizing:", err)
+	}
+	if _, err := io.ReadFull(ar, make([]byte, 200)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	mu.Lock()
+	if len(released) == 0 {
+		t.Error("no buffers released before Close")
+	}
+	mu.Unlock()
+	ar.Close()
+	ar.Close()
+	for _, buf := range bufs {
+		if n := released[&buf[0]]; n != 1 {
+			t.Errorf("supplied buffer released %d times", n)
+		}
+	}
+	for _, n := range released {
+		if n != 1 {
+			t.Errorf("buffer released %d times", n)
+		}
+	}
+	// 4 supplied buffers and 2 allocated by the last Resize.
+	if len(released) != 6 {
+		t.Errorf("want 6 buffers released, got %d", len(released))
+	}
+}
+
+func TestReaderConcurrencyCheck(t *testing.T) {
+	pr, pw := io.Pipe()
+	waiting := make(chan struct{}, 1)
+	notify := func(s readahead.State) {
+		if s == readahead.StateProducerBound {
+			select {
+			case waiting <- struct{}{}:
+			default:
+			}
+		}
+	}
+	ar, err := readahead.NewReaderSize(pr, 4, 10, readahead.WithConcurrencyCheck(), readahead.WithBackpressureCallback(notify))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Blocks until data is written.
+		if _, err := ar.Read(make([]byte, 10)); err != nil {
+			t.Error("error when reading:", err)
+		}
+	}()
+	// Wait for the read to block.
+	<-waiting
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("concurrent WriteTo did not panic")
+			}
+		}()
+		ar.(io.WriterTo).WriteTo(ioutil.Discard)
+	}()
+	pw.Write(make([]byte, 10))
+	<-done
+	// Sequential use is fine.
+	pw.Write(make([]byte, 10))
+	if _, err := ar.Read(make([]byte, 10)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	pw.Close()
+	ar.Close()
+}
+
+func TestReaderAs(t *testing.T) {
+	src := bytes.NewReader([]byte("Testbuffer"))
+	ar, err := readahead.NewReaderSize(src, 4, 10)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	var br *bytes.Reader
+	if !ar.(readahead.Reader).As(&br) || br != src {
+		t.Fatal("want input as *bytes.Reader")
+	}
+	var sizer interface{ Size() int64 }
+	if !ar.(readahead.Reader).As(&sizer) || sizer.Size() != 10 {
+		t.Fatal("want input as Size() int64")
+	}
+	var sr *strings.Reader
+	if ar.(readahead.Reader).As(&sr) {
+		t.Fatal("input is not a *strings.Reader")
+	}
+
+	// The input of NewReaderAt.
+	ra, err := readahead.NewReaderAt(src, 4, 10)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ra.Close()
+	br = nil
+	if !ra.(readahead.Reader).As(&br) || br != src {
+		t.Fatal("want input as *bytes.Reader")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic for non-pointer target")
+			}
+		}()
+		ar.(readahead.Reader).As(10)
+	}()
+}
+
+func TestReaderRightSizing(t *testing.T) {
+	tests := []struct {
+		expected      int64
+		buffers, size int
+		want          int
+	}{
+		{expected: 10, buffers: 4, size: 4 << 20, want: 2 * 11},
+		{expected: 0, buffers: 4, size: 100, want: 2 * 1},
+		{expected: 250, buffers: 4, size: 100, want: 3 * 100},
+		{expected: 10000, buffers: 4, size: 100, want: 4 * 100},
+		{expected: 10, buffers: 1, size: 100, want: 1 * 11},
+	}
+	for _, test := range tests {
+		input := strings.Repeat("x", int(test.expected))
+		ar, err := readahead.NewReaderSize(strings.NewReader(input), test.buffers, test.size, readahead.WithRightSizing(test.expected))
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		c := ar.(readahead.Reader)
+		if got := c.Buffered() + c.Free(); got != test.want {
+			t.Errorf("expected %d, %dx%d: want readahead.Reader %d, got %d", test.expected, test.buffers, test.size, test.want, got)
+		}
+		got, err := ioutil.ReadAll(ar)
+		if err != nil {
+			t.Fatal("error when reading:", err)
+		}
+		if string(got) != input {
+			t.Fatal("output mismatch")
+		}
+		ar.Close()
+	}
+
+	// Larger input than expected.
+	input := strings.Repeat("x", 1000)
+	ar, err := readahead.NewReaderSize(strings.NewReader(input), 4, 1<<20, readahead.WithRightSizing(10))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	if got, err := ioutil.ReadAll(ar); err != nil || string(got) != input {
+		t.Fatalf("output mismatch, error: %v", err)
+	}
+}
+
+func TestReaderEOFError(t *testing.T) {
+	errEnd := errors.New("end of stream")
+	ar, err := readahead.NewReaderSize(strings.NewReader("Testbuffer"), 4, 4, readahead.WithEOFError(errEnd))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	got, err := ioutil.ReadAll(ar)
+	if err != errEnd {
+		t.Fatal("want", errEnd, "got", err)
+	}
+	if string(got) != "Testbuffer" {
+		t.Fatalf("want %q, got %q", "Testbuffer", got)
+	}
+	if n, err := ar.Read(make([]byte, 10)); n != 0 || err != errEnd {
+		t.Fatalf("want (0, %v), got (%d, %v)", errEnd, n, err)
+	}
+
+	// WriteTo returns the error after writing everything.
+	ar2, err := readahead.NewReaderSize(strings.NewReader("Testbuffer"), 4, 4, readahead.WithEOFError(errEnd))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar2.Close()
+	var dst bytes.Buffer
+	n, err := io.Copy(&dst, ar2)
+	if n != 10 || err != errEnd {
+		t.Fatalf("want (10, %v), got (%d, %v)", errEnd, n, err)
+	}
+
+	// So do WriteToMulti and ForEachBuffer.
+	ar4, err := readahead.NewReaderSize(strings.NewReader("Testbuffer"), 4, 4, readahead.WithEOFError(errEnd))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar4.Close()
+	dst.Reset()
+	n, err = ar4.(readahead.Reader).WriteToMulti(&dst)
+	if n != 10 || err != errEnd {
+		t.Fatalf("want (10, %v), got (%d, %v)", errEnd, n, err)
+	}
+	ar5, err := readahead.NewReaderSize(strings.NewReader("Testbuffer"), 4, 4, readahead.WithEOFError(errEnd))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar5.Close()
+	err = ar5.(readahead.Reader).ForEachBuffer(context.Background(), func(b []byte) error { return nil })
+	if err != errEnd {
+		t.Fatal("want", errEnd, "got", err)
+	}
+
+	// The other read methods return it at the end of the input.
+	ends := map[string]func(r readahead.Reader) error{
+		"ReadBuffer": func(r readahead.Reader) error {
+			for {
+				if _, err := r.ReadBuffer(); err != nil {
+					return err
+				}
+			}
+		},
+		"ReadVec": func(r readahead.Reader) error {
+			_, err := r.ReadVec(make([]byte, 10), make([]byte, 1))
+			return err
+		},
+		"ReadN": func(r readahead.Reader) error {
+			r.ReadN(10)
+			_, err := r.ReadN(1)
+			return err
+		},
+		"ReadAtLeast": func(r readahead.Reader) error {
+			r.ReadAtLeast(make([]byte, 10), 10)
+			_, err := r.ReadAtLeast(make([]byte, 1), 1)
+			return err
+		},
+		"ReadUntil": func(r readahead.Reader) error {
+			b, err := r.ReadUntil('x')
+			if string(b) != "Testbuffer" {
+				t.Errorf("ReadUntil: want %q, got %q", "Testbuffer", b)
+			}
+			return err
+		},
+		"Peek": func(r readahead.Reader) error {
+			b, err := r.Peek(11)
+			if string(b) != "Testbuffer" {
+				t.Errorf("Peek: want %q, got %q", "Testbuffer", b)
+			}
+			return err
+		},
+	}
+	for name, fn := range ends {
+		ar, err := readahead.NewReaderSize(strings.NewReader("Testbuffer"), 4, 4, readahead.WithEOFError(errEnd))
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		if err := fn(ar.(readahead.Reader)); err != errEnd {
+			t.Errorf("%s: want %v, got %v", name, errEnd, err)
+		}
+		ar.Close()
+	}
+
+	// Reading to the end without an error still returns nil.
+	ar6, err := readahead.NewReaderSize(strings.NewReader("Testbuffer"), 4, 4, readahead.WithEOFError(errEnd))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar6.Close()
+	if b, err := ar6.(readahead.Reader).ReadAllLimit(100); err != nil || string(b) != "Testbuffer" {
+		t.Fatalf("ReadAllLimit: want (%q, nil), got (%q, %v)", "Testbuffer", b, err)
+	}
+	ar7, err := readahead.NewReaderSize(strings.NewReader("Testbuffer"), 4, 4, readahead.WithEOFError(errEnd))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar7.Close()
+	if n, err := ar7.(readahead.Reader).DrainToEOF(); n != 10 || err != nil {
+		t.Fatalf("DrainToEOF: want (10, nil), got (%d, %v)", n, err)
+	}
+	ar8, err := readahead.NewReaderSize(strings.NewReader("Testbuffer"), 4, 4, readahead.WithEOFError(errEnd))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if err := ar8.(readahead.Reader).CloseDrain(100); err != nil {
+		t.Fatal("CloseDrain: want nil, got", err)
+	}
+
+	// io.EOF is the default.
+	ar3, err := readahead.NewReaderSize(strings.NewReader("Testbuffer"), 4, 4, readahead.WithEOFError(io.EOF))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar3.Close()
+	if n, err := io.Copy(ioutil.Discard, ar3); n != 10 || err != nil {
+		t.Fatalf("want (10, nil), got (%d, %v)", n, err)
+	}
+}
+
+func TestReaderSetMaxLookahead(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 8, 10, readahead.WithLazyStart())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	la := ar.(readahead.Reader)
+	la.SetMaxLookahead(25)
+	waitBuffered := func(want int) {
+		t.Helper()
+		waitFor(t, fmt.Sprint(want, " bytes to be buffered"), func() bool { return la.Buffered() == want })
+		// Make sure no more is read.
+		time.Sleep(10 * time.Millisecond)
+		if got := la.Buffered(); got != want {
+			t.Fatalf("want %d buffered, got %d", want, got)
+		}
+	}
+	got := make([]byte, 10)
+	if _, err := io.ReadFull(ar, got); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	// Buffers are filled until 25 bytes are read ahead.
+	waitBuffered(30)
+
+	// Lower the limit below what has been read ahead.
+	la.SetMaxLookahead(5)
+	if _, err := io.ReadFull(ar, got); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	waitBuffered(20)
+	if _, err := io.ReadFull(ar, make([]byte, 20)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	waitBuffered(10)
+
+	// Peek reads past the limit.
+	peeked := make(chan []byte, 1)
+	go func() {
+		b, err := ar.(readahead.Reader).Peek(35)
+		if err != nil {
+			t.Error("error when peeking:", err)
+		}
+		peeked <- append([]byte(nil), b...)
+	}()
+	select {
+	case b := <-peeked:
+		if !bytes.Equal(b, input[40:75]) {
+			t.Fatal("peek mismatch")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Peek blocked by the lookahead limit")
+	}
+
+	// No limit.
+	la.SetMaxLookahead(0)
+	waitBuffered(80)
+	rest, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(rest, input[40:]) {
+		t.Fatal("output mismatch")
+	}
+}
+
+func TestReaderLazyStartClose(t *testing.T) {
+	var reads int32
+	src := &testCloser{Reader: dummyReader{readFN: func(dst []byte) (int, error) {
+		atomic.AddInt32(&reads, 1)
+		return 0, io.EOF
+	}}}
+	ar, err := readahead.NewReadCloserSize(src, 4, 10, readahead.WithLazyStart())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- ar.Close()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("error when closing:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return")
+	}
+	if err := ar.Close(); err != nil {
+		t.Fatal("error when closing again:", err)
+	}
+	if src.closed != 1 {
+		t.Fatalf("want input closed once, got %d", src.closed)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := ar.Read(make([]byte, 10)); err != readahead.ErrClosed {
+			t.Fatal("want", readahead.ErrClosed, "got", err)
+		}
+	}
+	if n := atomic.LoadInt32(&reads); n != 0 {
+		t.Fatalf("input read %d times", n)
+	}
+}
+
+func TestReaderImmediateForward(t *testing.T) {
+	pr, pw := io.Pipe()
+	ar, err := readahead.NewReaderSize(pr, 4, 100, readahead.WithImmediateForward())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer func() {
+		// Unblock the input before closing.
+		pw.Close()
+		ar.Close()
+	}()
+	for i := 0; i < 5; i++ {
+		want := strings.Repeat("x", i+1)
+		go pw.Write([]byte(want))
+		got := make([]byte, 100)
+		done := make(chan int)
+		go func() {
+			n, _ := ar.Read(got)
+			done <- n
+		}()
+		select {
+		case n := <-done:
+			if string(got[:n]) != want {
+				t.Fatalf("want %q, got %q", want, got[:n])
+			}
+		case <-time.After(time.Second):
+			t.Fatal("data was not forwarded")
+		}
+	}
+}
+
+func TestReaderCloseDuringRead(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		input := make([]byte, 1<<20)
+		for j := range input {
+			input[j] = byte(j % 251)
+		}
+		ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 1000)
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		var got []byte
+		done := make(chan error)
+		go func() {
+			buf := make([]byte, 300)
+			for {
+				n, err := ar.Read(buf)
+				got = append(got, buf[:n]...)
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+		}()
+		time.Sleep(time.Duration(i) * 10 * time.Microsecond)
+		if err := ar.Close(); err != nil {
+			t.Fatal("error when closing:", err)
+		}
+		err = <-done
+		if err != readahead.ErrClosed && err != io.EOF {
+			t.Fatal("unexpected error:", err)
+		}
+		if !bytes.Equal(got, input[:len(got)]) {
+			t.Fatal("data mismatch")
+		}
+		if off := ar.(readahead.Reader).Offset(); off != int64(len(got)) {
+			t.Fatalf("read %d bytes, but offset is %d", len(got), off)
+		}
+	}
+}
+
+func TestReaderBackpressureCallback(t *testing.T) {
+	record := func() (readahead.Option, func() []readahead.State) {
+		var mu sync.Mutex
+		var states []readahead.State
+		opt := readahead.WithBackpressureCallback(func(state readahead.State) {
+			mu.Lock()
+			states = append(states, state)
+			mu.Unlock()
+		})
+		return opt, func() []readahead.State {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]readahead.State(nil), states...)
+		}
+	}
+	seen := func(states []readahead.State, want readahead.State) bool {
+		for _, s := range states {
+			if s == want {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Slow input.
+	opt, states := record()
+	slow := dummyReader{readFN: func(dst []byte) (int, error) {
+		time.Sleep(time.Millisecond)
+		return len(dst), nil
+	}}
+	ar, err := readahead.NewReaderSize(io.LimitReader(slow, 1000), 4, 100, opt)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, ar); err != nil {
+		t.Fatal(err)
+	}
+	ar.Close()
+	if got := states(); !seen(got, readahead.StateProducerBound) || !seen(got, readahead.StateBalanced) {
+		t.Fatal("want producer-bound and balanced states, got", got)
+	}
+
+	// Slow consumer.
+	opt, states = record()
+	ar, err = readahead.NewReaderSize(bytes.NewReader(make([]byte, 1000)), 4, 100, opt)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	buf := make([]byte, 100)
+	for {
+		time.Sleep(time.Millisecond)
+		if _, err := ar.Read(buf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ar.Close()
+	if got := states(); !seen(got, readahead.StateConsumerBound) {
+		t.Fatal("want consumer-bound state, got", got)
+	}
+
+	if _, err := readahead.NewReaderSize(bytes.NewReader(nil), 4, 100, readahead.WithBackpressureCallback(nil)); err == nil {
+		t.Fatal("want error for nil callback")
+	}
+}
+
+func TestSeekerWriteRange(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	ar, err := readahead.NewReadSeekerSize(bytes.NewReader(input), 4, 64)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	for _, r := range [][2]int64{{0, 10}, {500, 200}, {3, 0}, {990, 10}, {100, 1}} {
+		dst := &bytes.Buffer{}
+		n, err := ar.(readahead.SeekableReader).WriteRange(dst, r[0], r[1])
+		if err != nil {
+			t.Fatal("error when writing:", err)
+		}
+		if n != r[1] || !bytes.Equal(dst.Bytes(), input[r[0]:r[0]+r[1]]) {
+			t.Fatalf("range %v: wrote %d, got %q", r, n, dst.Bytes())
+		}
+		if pos, err := ar.Seek(0, io.SeekCurrent); err != nil || pos != r[0]+r[1] {
+			t.Fatalf("range %v: want position %d, got %d (%v)", r, r[0]+r[1], pos, err)
+		}
+	}
+	// Over the end of the input.
+	dst := &bytes.Buffer{}
+	n, err := ar.(readahead.SeekableReader).WriteRange(dst, 950, 100)
+	if err != io.EOF || n != 50 || !bytes.Equal(dst.Bytes(), input[950:]) {
+		t.Fatalf("want 50 bytes and io.EOF, got %d, %v", n, err)
+	}
+	n, err = ar.(readahead.SeekableReader).WriteRange(dst, 2000, 10)
+	if err != io.EOF || n != 0 {
+		t.Fatalf("want 0 bytes and io.EOF, got %d, %v", n, err)
+	}
+	if _, err := ar.(readahead.SeekableReader).WriteRange(dst, -1, 10); err == nil {
+		t.Fatal("want error for negative offset")
+	}
+}
+
+func TestReaderSetAccessMode(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	var reads int32
+	src := bytes.NewReader(input)
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		atomic.AddInt32(&reads, 1)
+		return src.Read(dst)
+	}}
+	ar, err := readahead.NewReaderSize(r, 4, 10, readahead.WithLazyStart())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	am := ar.(readahead.Reader)
+	if am.AccessMode() != readahead.AccessSequential {
+		t.Fatal("want sequential access by default")
+	}
+	if err := am.SetAccessMode(readahead.AccessMode(10)); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+	if err := am.SetAccessMode(readahead.AccessRandom); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if am.AccessMode() != readahead.AccessRandom {
+		t.Fatal("want random access")
+	}
+	// The first buffer is returned and one more is read ahead.
+	if _, err := io.ReadFull(ar, make([]byte, 10)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	waitFor(t, "2 reads", func() bool { return atomic.LoadInt32(&reads) >= 2 })
+	if n := atomic.LoadInt32(&reads); n != 2 {
+		t.Fatalf("want 2 reads, got %d", n)
+	}
+
+	if err := am.SetAccessMode(readahead.AccessSequential); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	waitFor(t, "5 reads", func() bool { return atomic.LoadInt32(&reads) >= 5 })
+	if n := atomic.LoadInt32(&reads); n != 5 {
+		t.Fatalf("want 5 reads, got %d", n)
+	}
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(got, input[10:]) {
+		t.Fatal("output mismatch")
+	}
+	if n := am.Stats().ModeSwitches; n != 2 {
+		t.Fatalf("want 2 mode switches, got %d", n)
+	}
+
+	// Data is handed over after each read in random mode.
+	block := make(chan struct{})
+	var calls int32
+	r = dummyReader{readFN: func(dst []byte) (int, error) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			<-block
+			return 0, io.EOF
+		}
+		return copy(dst, "small"), nil
+	}}
+	ar2, err := readahead.NewReaderSize(r, 4, 100, readahead.WithLazyStart())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer func() {
+		close(block)
+		ar2.Close()
+	}()
+	if err := ar2.(readahead.Reader).SetAccessMode(readahead.AccessRandom); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	done := make(chan int, 1)
+	go func() {
+		n, _ := ar2.Read(make([]byte, 100))
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		if n != 5 {
+			t.Fatal("want 5 bytes, got", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read waited for the buffer to be filled")
+	}
+}
+
+func TestReaderReadAllLimit(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	for _, max := range []int64{0, 1, 999, 1000, 5000} {
+		ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 64)
+		if err != nil {
+			t.Fatal("error when creating:", err)
+		}
+		got, err := ar.(readahead.Reader).ReadAllLimit(max)
+		want := input
+		if max < int64(len(input)) {
+			want = input[:max]
+			if err != readahead.ErrLimitExceeded {
+				t.Fatalf("limit %d: want %v, got %v", max, readahead.ErrLimitExceeded, err)
+			}
+		} else if err != nil {
+			t.Fatalf("limit %d: unexpected error: %v", max, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("limit %d: got %d bytes, want %d", max, len(got), len(want))
+		}
+		// The rest can still be read.
+		rest, err := ioutil.ReadAll(ar)
+		if err != nil {
+			t.Fatalf("limit %d: error when reading: %v", max, err)
+		}
+		if !bytes.Equal(append(got, rest...), input) {
+			t.Fatalf("limit %d: output mismatch", max)
+		}
+		ar.Close()
+	}
+
+	// The input isn't read far past the limit.
+	var read int64
+	src := bytes.NewReader(input)
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		n, err := src.Read(dst)
+		atomic.AddInt64(&read, int64(n))
+		return n, err
+	}}
+	ar, err := readahead.NewReaderSize(r, 4, 10, readahead.WithLazyStart())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	got, err := ar.(readahead.Reader).ReadAllLimit(100)
+	if err != readahead.ErrLimitExceeded || !bytes.Equal(got, input[:100]) {
+		t.Fatalf("want 100 bytes and %v, got %d, %v", readahead.ErrLimitExceeded, len(got), err)
+	}
+	if n := atomic.LoadInt64(&read); n > 110 {
+		t.Fatalf("read %d bytes from input, want at most 110", n)
+	}
+	if _, err := ar.(readahead.Reader).ReadAllLimit(-1); err == nil {
+		t.Fatal("want error for negative limit")
+	}
+}
+
+func TestReaderClearError(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	errTransient := errors.New("transient error")
+	src := bytes.NewReader(input)
+	var calls int
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		calls++
+		if calls == 3 {
+			return 0, errTransient
+		}
+		return src.Read(dst)
+	}}
+	ar, err := readahead.NewReaderSize(r, 4, 64, readahead.WithLazyStart())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	ec := ar.(readahead.Reader)
+	if err := ec.ClearError(); err != nil {
+		t.Fatal("want nil without error, got", err)
+	}
+	// An error that hasn't been returned by a read is reported, but not cleared.
+	if err := ar.(readahead.Reader).WaitSaturated(context.Background()); err != errTransient {
+		t.Fatal("want", errTransient, "got", err)
+	}
+	if err := ec.ClearError(); err != errTransient {
+		t.Fatal("want", errTransient, "got", err)
+	}
+	got, err := ioutil.ReadAll(ar)
+	if !errors.Is(err, errTransient) {
+		t.Fatal("want", errTransient, "got", err)
+	}
+	if err := ec.ClearError(); err != nil {
+		t.Fatal("error when clearing:", err)
+	}
+	rest, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(append(got, rest...), input) {
+		t.Fatal("output mismatch")
+	}
+	if err := ec.ClearError(); err != io.EOF {
+		t.Fatal("want io.EOF at end, got", err)
+	}
+	ar.Close()
+	if err := ec.ClearError(); err != readahead.ErrClosed {
+		t.Fatal("want", readahead.ErrClosed, "got", err)
+	}
+}
+
+func TestReaderRemaining(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	ar, err := readahead.NewReaderSize(&io.LimitedReader{R: bytes.NewReader(input), N: 500}, 4, 64)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	if n := ar.(readahead.Reader).Remaining(); n != 500 {
+		t.Fatalf("want 500 remaining, got %d", n)
+	}
+	if _, err := io.ReadFull(ar, make([]byte, 123)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if n := ar.(readahead.Reader).Remaining(); n != 377 {
+		t.Fatalf("want 377 remaining, got %d", n)
+	}
+	if _, err := ioutil.ReadAll(ar); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if n := ar.(readahead.Reader).Remaining(); n != 0 {
+		t.Fatalf("want 0 remaining, got %d", n)
+	}
+
+	unlimited, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 64)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer unlimited.Close()
+	if n := unlimited.(readahead.Reader).Remaining(); n != -1 {
+		t.Fatalf("want -1 remaining, got %d", n)
+	}
+
+	at, err := readahead.NewArchiveReaderAt(bytes.NewReader(input), 800, 4, 64)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer at.Close()
+	if _, err := io.ReadFull(at, make([]byte, 100)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if n := at.(readahead.Reader).Remaining(); n != 700 {
+		t.Fatalf("want 700 remaining, got %d", n)
+	}
+	if _, err := at.(io.Seeker).Seek(750, io.SeekStart); err != nil {
+		t.Fatal("error when seeking:", err)
+	}
+	if n := at.(readahead.Reader).Remaining(); n != 50 {
+		t.Fatalf("want 50 remaining, got %d", n)
+	}
+}
+
+func TestReaderResetSizeLazyBuffers(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789", 100))
+	var released int
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 100,
+		readahead.WithLazyBuffers(), readahead.WithReleaseFunc(func(buf []byte) { released++ }))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	// Allocate all buffers.
+	if _, err := ioutil.ReadAll(ar); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if err := ar.(readahead.Reader).ResetSize(bytes.NewReader(input), 4, 100); err != nil {
+		t.Fatal("error when resetting:", err)
+	}
+	if released != 0 {
+		t.Fatalf("%d buffers dropped by ResetSize", released)
+	}
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+	ar.Close()
+	if released != 4 {
+		t.Fatalf("want 4 buffers released on Close, got %d", released)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package readahead
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// ReadAtCloser is a reader that supports io.ReaderAt.
+type ReadAtCloser interface {
+	io.ReadCloser
+	io.ReaderAt
+}
+
+// readerAt reads sequentially from an io.ReaderAt.
+type readerAt struct {
+	rd  io.ReaderAt
+	off int64
+}
+
+func (r *readerAt) Read(p []byte) (n int, err error) {
+	n, err = r.rd.ReadAt(p, r.off)
+	r.off += int64(n)
+	return n, err
+}
+
+// Seek sets the offset of the next Read.
+// io.SeekEnd is only supported if the input has a Size method,
+// like *io.SectionReader and *bytes.Reader, or is an *os.File.
+func (r *readerAt) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		size, err := r.size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, errors.New("readahead: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("readahead: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// size returns the size of the input, if it can be determined.
+func (r *readerAt) size() (int64, error) {
+	switch rd := r.rd.(type) {
+	case interface{ Size() int64 }:
+		return rd.Size(), nil
+	case *os.File:
+		st, err := rd.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return st.Size(), nil
+	}
+	return 0, errors.New("readahead: size of input unknown")
+}
+
+// prefetchReaderAt serves sequential ReadAt calls from read-ahead data.
+type prefetchReaderAt struct {
+	*reader
+	src     *readerAt
+	atMu    sync.Mutex // Serializes ReadAt access to the stream.
+	lastEnd int64      // End of the last ReadAt call.
+}
+
+// NewReaderAt returns a reader that reads ahead from an io.ReaderAt,
+// starting at offset 0.
+//
+// ReadAt calls that continue where the previous ReadAt call ended
+// are served from the data read ahead. If the position of the read-ahead
+// doesn't match, it is moved to the new position.
+// Other ReadAt calls are forwarded directly to the input.
+// ReadAt can be called concurrently, but calls served from read-ahead data
+// will be serialized.
+//
+// Read will continue from the position of the read-ahead,
+// which is moved by sequential ReadAt calls.
+// The returned reader also implements io.Seeker,
+// which moves the position of the read-ahead.
+func NewReaderAt(rd io.ReaderAt, buffers, size int, opts ...Option) (ReadAtCloser, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("buffer size too small")
+	}
+	if buffers <= 0 {
+		return nil, fmt.Errorf("number of buffers too small")
+	}
+	if rd == nil {
+		return nil, fmt.Errorf("nil input reader supplied")
+	}
+	a := &reader{}
+	if err := a.setOptions(opts); err != nil {
+		return nil, err
+	}
+	src := &readerAt{rd: rd}
+	a.init(src, buffers, size)
+	return &prefetchReaderAt{reader: a, src: src}, nil
+}
+
+// NewArchiveReaderAt returns a reader like NewReaderAt,
+// for an input of a known size, like an archive file read with archive/zip.
+// Reads are limited to size bytes, so ReadAt returns io.EOF for reads
+// at or beyond size, and the available data with io.EOF for reads crossing size,
+// even if the input doesn't report this correctly.
+// Seeking relative to the end uses size.
+func NewArchiveReaderAt(rd io.ReaderAt, size int64, buffers, bufSize int, opts ...Option) (ReadAtCloser, error) {
+	if rd == nil {
+		return nil, fmt.Errorf("nil input reader supplied")
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("negative size")
+	}
+	return NewReaderAt(io.NewSectionReader(rd, 0, size), buffers, bufSize, opts...)
+}
+
+// Seek sets the position of the read-ahead and Read.
+// It does not affect ReadAt.
+// io.SeekEnd is only supported if the input has a Size method,
+// like *io.SectionReader and *bytes.Reader, or is an *os.File.
+func (r *prefetchReaderAt) Seek(offset int64, whence int) (int64, error) {
+	r.atMu.Lock()
+	defer r.atMu.Unlock()
+	if r.closed {
+		return 0, errors.New("readahead: Seek after Close")
+	}
+	s := seekable{r.reader}
+	return s.Seek(offset, whence)
+}
+
+// Clone returns a new reader with its own buffers, reading ahead from
+// the position of Read. It can be used independently of this reader.
+func (r *prefetchReaderAt) Clone() (ReadSeekCloser, error) {
+	r.atMu.Lock()
+	defer r.atMu.Unlock()
+	return r.reader.Clone()
+}
+
+// ReadAt reads len(p) bytes starting at offset off.
+func (r *prefetchReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("readahead: negative offset")
+	}
+	r.atMu.Lock()
+	sequential := off == r.lastEnd
+	r.lastEnd = off + int64(len(p))
+	if off != r.Offset() {
+		if !sequential {
+			r.atMu.Unlock()
+			return r.src.rd.ReadAt(p, off)
+		}
+		if r.closed {
+			r.atMu.Unlock()
+			return 0, ErrClosed
+		}
+		// Move the read-ahead to the new position.
+		r.stop()
+		r.src.off = off
+		r.restart(off)
+	}
+	defer r.atMu.Unlock()
+	n, err = io.ReadFull(r.reader, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Remaining returns the number of bytes left from the position of Read
+// to the end of the input.
+// The size of the input is known if it has a Size method,
+// like *io.SectionReader and readers returned by NewArchiveReaderAt,
+// or is an *os.File. Otherwise -1 is returned.
+func (r *prefetchReaderAt) Remaining() int64 {
+	size, err := r.src.size()
+	if err != nil {
+		return -1
+	}
+	if n := size - r.Offset(); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// ReadSeekAtCloser is a reader that supports seeking and io.ReaderAt.
+type ReadSeekAtCloser interface {
+	ReadSeekCloser
+	io.ReaderAt
+}
+
+// seekableReaderAt reads ahead with Read and Seek,
+// and forwards ReadAt to the input.
+type seekableReaderAt struct {
+	*seekable
+	rd     io.ReaderAt
+	atMu   sync.Mutex // Serializes ReadAt and protects closed.
+	closed bool
+}
+
+// NewSeekableReaderAt returns a reader that reads ahead from rd with Read,
+// and supports both Seek and ReadAt.
+//
+// Read and Seek use the read-ahead like NewReadSeekerSize.
+// ReadAt is forwarded directly to rd, and neither uses nor changes the
+// position of Read and Seek, so ReadAt can be called concurrently with them.
+// ReadAt calls are serialized.
+func NewSeekableReaderAt(rd interface {
+	io.ReadSeeker
+	io.ReaderAt
+}, buffers, size int, opts ...Option) (ReadSeekAtCloser, error) {
+	if rd == nil {
+		return nil, fmt.Errorf("nil input reader supplied")
+	}
+	res, err := NewReadSeekerSize(rd, buffers, size, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &seekableReaderAt{seekable: res.(*seekable), rd: rd}, nil
+}
+
+// ReadAt reads len(p) bytes from the input starting at offset off.
+func (r *seekableReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	r.atMu.Lock()
+	defer r.atMu.Unlock()
+	if r.closed {
+		return 0, ErrClosed
+	}
+	return r.rd.ReadAt(p, off)
+}
+
+// Close closes the reader like the readers returned by NewReaderSize.
+// It waits for ReadAt calls to finish.
+func (r *seekableReaderAt) Close() error {
+	r.atMu.Lock()
+	r.closed = true
+	r.atMu.Unlock()
+	return r.seekable.Close()
+}
+
+// NewSectionReaderFactory returns a function that creates readers
+// reading ahead from sections of r, for example entries in an archive.
+// Each returned reader reads n bytes starting at offset off,
+// and supports seeking within the section.
+//
+// Readers use the default number of buffers and buffer size, see SetDefaults.
+// Buffers are returned to a pool shared by the readers of the factory
+// when they are closed, so the readers must be closed after use.
+// Readers are independent and can be used concurrently.
+func NewSectionReaderFactory(r io.ReaderAt) func(off, n int64) ReadSeekCloser {
+	buffers, size := defaults()
+	pool := sync.Pool{New: func() interface{} {
+		x := make([]byte, buffers*size)
+		bufs := make([][]byte, buffers)
+		for i := range bufs {
+			bufs[i] = x[i*size : (i+1)*size : (i+1)*size]
+		}
+		return &bufs
+	}}
+	return func(off, n int64) ReadSeekCloser {
+		bufs := pool.Get().(*[][]byte)
+		release := closerFunc(func() error {
+			pool.Put(bufs)
+			return nil
+		})
+		rd, err := NewReaderBuffer(io.NewSectionReader(r, off, n), *bufs, WithCloser(release))
+		if err != nil {
+			// Should not be possible, since the buffers are valid.
+			panic("unexpected error:" + err.Error())
+		}
+		return rd.(ReadSeekCloser)
+	}
+}
+
+// closerFunc is a function used as an io.Closer.
+type closerFunc func() error
+
+func (c closerFunc) Close() error {
+	return c()
+}
@@ -0,0 +1,300 @@
+package readahead_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/readahead"
+)
+
+func TestReaderAt(t *testing.T) {
+	input := make([]byte, 10000)
+	rng := rand.New(rand.NewSource(0))
+	rng.Read(input)
+	ar, err := readahead.NewReaderAt(bytes.NewReader(input), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	check := func(off int64, size int) {
+		t.Helper()
+		dst := make([]byte, size)
+		n, err := ar.ReadAt(dst, off)
+		want := input[off:]
+		if len(want) > size {
+			want = want[:size]
+		}
+		if n != len(want) {
+			t.Fatalf("offset %d: unexpected length, expected %d, got %d (%v)", off, len(want), n, err)
+		}
+		if n < size && err != io.EOF {
+			t.Fatalf("offset %d: expected io.EOF, got %v", off, err)
+		}
+		if n == size && err != nil {
+			t.Fatalf("offset %d: unexpected error %v", off, err)
+		}
+		if !bytes.Equal(dst[:n], want) {
+			t.Fatalf("offset %d: content mismatch", off)
+		}
+	}
+	// Sequential
+	for off := int64(0); off < 3000; off += 33 {
+		check(off, 33)
+	}
+	// Random, followed by sequential
+	for i := 0; i < 50; i++ {
+		off := rng.Int63n(int64(len(input)))
+		check(off, 50)
+		check(off+50, 70)
+	}
+	// Tail
+	check(9990, 20)
+	check(10000, 20)
+
+	// Concurrent use
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			dst := make([]byte, 64)
+			for i := 0; i < 200; i++ {
+				off := rng.Int63n(int64(len(input) - len(dst)))
+				n, err := ar.ReadAt(dst, off)
+				if err != nil || !bytes.Equal(dst[:n], input[off:off+int64(n)]) || n != len(dst) {
+					t.Errorf("offset %d: mismatch (n: %d, err: %v)", off, n, err)
+					return
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+}
+
+func TestSectionReaderFactory(t *testing.T) {
+	input := make([]byte, 10000)
+	rng := rand.New(rand.NewSource(0))
+	rng.Read(input)
+	if err := readahead.SetDefaults(3, 100); err != nil {
+		t.Fatal(err)
+	}
+	newSection := readahead.NewSectionReaderFactory(bytes.NewReader(input))
+	readahead.SetDefaults(readahead.DefaultBuffers, readahead.DefaultBufferSize)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				off, n := int64(i*1000+j*10), int64(500+j*50)
+				rd := newSection(off, n)
+				got, err := ioutil.ReadAll(rd)
+				if err != nil {
+					t.Error("error when reading:", err)
+					return
+				}
+				if !bytes.Equal(got, input[off:off+n]) {
+					t.Errorf("section %d+%d: data mismatch", off, n)
+					return
+				}
+				// Seek within the section.
+				if _, err := rd.Seek(-10, io.SeekEnd); err != nil {
+					t.Error("error when seeking:", err)
+					return
+				}
+				got, err = ioutil.ReadAll(rd)
+				if err != nil || !bytes.Equal(got, input[off+n-10:off+n]) {
+					t.Errorf("section %d+%d: data mismatch after seek: %v", off, n, err)
+					return
+				}
+				if err := rd.Close(); err != nil {
+					t.Error("error when closing:", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestReaderAtSeek(t *testing.T) {
+	input := make([]byte, 10000)
+	rng := rand.New(rand.NewSource(0))
+	rng.Read(input)
+	ar, err := readahead.NewReaderAt(bytes.NewReader(input), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	sk, ok := ar.(io.Seeker)
+	if !ok {
+		t.Fatal("reader does not implement io.Seeker")
+	}
+	check := func(pos int64, n int) {
+		t.Helper()
+		got := make([]byte, n)
+		if _, err := io.ReadFull(ar, got); err != nil {
+			t.Fatal("error when reading:", err)
+		}
+		if !bytes.Equal(got, input[pos:pos+int64(n)]) {
+			t.Fatalf("data mismatch at %d", pos)
+		}
+	}
+	check(0, 150)
+	tests := []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{offset: 5000, whence: io.SeekStart, want: 5000},
+		{offset: 1000, whence: io.SeekStart, want: 1000},
+		{offset: 2345, whence: io.SeekCurrent, want: 1000 + 250 + 2345},
+		{offset: -3000, whence: io.SeekCurrent, want: 1000 + 250 + 2345 + 250 - 3000},
+		{offset: -500, whence: io.SeekEnd, want: 9500},
+	}
+	for _, test := range tests {
+		pos, err := sk.Seek(test.offset, test.whence)
+		if err != nil {
+			t.Fatal("error when seeking:", err)
+		}
+		if pos != test.want {
+			t.Fatalf("want position %d, got %d", test.want, pos)
+		}
+		check(pos, 250)
+	}
+	if _, err := sk.Seek(-1, io.SeekStart); err == nil {
+		t.Fatal("expected error seeking to negative position")
+	}
+
+	// Without a size, seeking relative to the end is not possible.
+	ar2, err := readahead.NewReaderAt(struct{ io.ReaderAt }{bytes.NewReader(input)}, 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar2.Close()
+	if _, err := ar2.(io.Seeker).Seek(-10, io.SeekEnd); err == nil {
+		t.Fatal("expected error seeking relative to the end")
+	}
+}
+
+func TestArchiveReaderAt(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := map[string][]byte{}
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("file%d", i)
+		data := make([]byte, 1000*i)
+		rng.Read(data)
+		files[name] = data
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(buf.Len())
+	// The input continues after the archive.
+	buf.Write(make([]byte, 1000))
+
+	ar, err := readahead.NewArchiveReaderAt(bytes.NewReader(buf.Bytes()), size, 4, 512)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	zr, err := zip.NewReader(ar, size)
+	if err != nil {
+		t.Fatal("error when opening archive:", err)
+	}
+	if len(zr.File) != len(files) {
+		t.Fatalf("want %d files, got %d", len(files), len(zr.File))
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal("error when opening file:", err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal("error when reading file:", err)
+		}
+		if !bytes.Equal(got, files[f.Name]) {
+			t.Fatalf("%s: content mismatch", f.Name)
+		}
+	}
+
+	// Reads at the end.
+	p := make([]byte, 10)
+	if n, err := ar.ReadAt(p, size-5); n != 5 || err != io.EOF {
+		t.Fatalf("want (5, io.EOF), got (%d, %v)", n, err)
+	}
+	if n, err := ar.ReadAt(p, size); n != 0 || err != io.EOF {
+		t.Fatalf("want (0, io.EOF), got (%d, %v)", n, err)
+	}
+	if n, err := ar.ReadAt(p, size+100); n != 0 || err != io.EOF {
+		t.Fatalf("want (0, io.EOF), got (%d, %v)", n, err)
+	}
+}
+
+func TestSeekableReaderAt(t *testing.T) {
+	input := make([]byte, 10000)
+	rng := rand.New(rand.NewSource(0))
+	rng.Read(input)
+	ar, err := readahead.NewSeekableReaderAt(bytes.NewReader(input), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	var wg sync.WaitGroup
+	// Random ReadAt calls.
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			p := make([]byte, 50)
+			for j := 0; j < 100; j++ {
+				off := rng.Int63n(int64(len(input) - len(p)))
+				if _, err := ar.ReadAt(p, off); err != nil {
+					t.Error("error when reading at:", err)
+					return
+				}
+				if !bytes.Equal(p, input[off:off+int64(len(p))]) {
+					t.Errorf("ReadAt(%d) mismatch", off)
+					return
+				}
+			}
+		}(int64(i))
+	}
+	// Sequential reads and seeks at the same time.
+	for _, pos := range []int64{0, 5000, 1234} {
+		if _, err := ar.Seek(pos, io.SeekStart); err != nil {
+			t.Fatal("error when seeking:", err)
+		}
+		got := make([]byte, 2000)
+		if _, err := io.ReadFull(ar, got); err != nil {
+			t.Fatal("error when reading:", err)
+		}
+		if !bytes.Equal(got, input[pos:pos+2000]) {
+			t.Fatalf("Read at %d mismatch", pos)
+		}
+	}
+	wg.Wait()
+	if err := ar.Close(); err != nil {
+		t.Fatal("error when closing:", err)
+	}
+	if _, err := ar.ReadAt(make([]byte, 10), 0); err == nil {
+		t.Fatal("expected error after Close")
+	}
+}
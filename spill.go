@@ -0,0 +1,206 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package readahead
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// spillReader reads ahead from an input into a temporary file,
+// which is used as a ring buffer.
+// The input is only read into the file while the memory buffers are full,
+// otherwise it is read directly.
+type spillReader struct {
+	src   io.Reader
+	dir   string
+	max   int64 // Size of the ring
+	chunk int   // Size of reads from src
+
+	mu      sync.Mutex
+	cond    *sync.Cond // Signalled when any of the fields below change.
+	f       *os.File
+	r, w    int64 // Total bytes read from and written to the ring
+	err     error // Error from src or the file, returned when all data has been read
+	busy    bool  // src is being read
+	full    bool  // The memory buffers are full
+	closed  bool
+	started bool
+}
+
+func newSpillReader(src io.Reader, dir string, buffers, size int) *spillReader {
+	s := &spillReader{src: src, dir: dir, max: int64(buffers) * int64(size), chunk: size}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// run reads from src into the file while the memory buffers are full,
+// until an error occurs.
+func (s *spillReader) run() {
+	f, err := os.CreateTemp(s.dir, "readahead-spill-*")
+	if err == nil {
+		// Remove at once, the file is kept until it is closed.
+		// This fails on some platforms, so it is also removed on Close.
+		os.Remove(f.Name())
+	}
+	s.mu.Lock()
+	if err != nil || s.closed {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		s.err = err
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		return
+	}
+	s.f = f
+	s.mu.Unlock()
+
+	buf := make([]byte, s.chunk)
+	for {
+		s.mu.Lock()
+		for !s.closed && s.err == nil && (s.busy || !s.full || s.w-s.r+int64(len(buf)) > s.max) {
+			s.cond.Wait()
+		}
+		if s.closed || s.err != nil {
+			s.mu.Unlock()
+			return
+		}
+		s.busy = true
+		s.mu.Unlock()
+
+		n, err := s.src.Read(buf)
+		if n > 0 {
+			if werr := s.write(buf[:n]); werr != nil {
+				err = werr
+			}
+		}
+		s.mu.Lock()
+		s.busy = false
+		if err != nil && s.err == nil {
+			s.err = err
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+// write p to the ring, which must have room for it.
+func (s *spillReader) write(p []byte) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	w := s.w
+	s.mu.Unlock()
+
+	// The region being written is not read until w is updated.
+	for len(p) > 0 {
+		pos := w % s.max
+		n := len(p)
+		if rem := s.max - pos; int64(n) > rem {
+			n = int(rem)
+		}
+		if _, err := s.f.WriteAt(p[:n], pos); err != nil {
+			return err
+		}
+		p = p[n:]
+		w += int64(n)
+	}
+
+	s.mu.Lock()
+	s.w = w
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return nil
+}
+
+// setFull tells whether the memory buffers are full,
+// and the input should be read into the file.
+func (s *spillReader) setFull(full bool) {
+	s.mu.Lock()
+	if s.full != full {
+		s.full = full
+		s.cond.Broadcast()
+	}
+	s.mu.Unlock()
+}
+
+// Read reads data from the ring,
+// or from src if nothing has been written to the ring.
+func (s *spillReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.mu.Lock()
+	if !s.started {
+		s.started = true
+		go s.run()
+	}
+	// Wait for data being read into the ring.
+	for s.r == s.w && s.busy && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		s.mu.Unlock()
+		return 0, ErrClosed
+	}
+	if s.r == s.w {
+		if s.err != nil {
+			s.mu.Unlock()
+			return 0, s.err
+		}
+		// Nothing is spilled, read directly from src.
+		s.busy = true
+		s.mu.Unlock()
+		n, err := s.src.Read(p)
+		s.mu.Lock()
+		s.busy = false
+		if err != nil && s.err == nil {
+			s.err = err
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		return n, err
+	}
+	r, avail := s.r, s.w-s.r
+	s.mu.Unlock()
+
+	// Read up to the end of the ring.
+	pos := r % s.max
+	if rem := s.max - pos; avail > rem {
+		avail = rem
+	}
+	if int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	n, err := s.f.ReadAt(p, pos)
+	s.mu.Lock()
+	s.r += int64(n)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if n < len(p) {
+		return n, err
+	}
+	return n, nil
+}
+
+// Close stops reading ahead and removes the file.
+// A read from src that is in progress is not interrupted.
+func (s *spillReader) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	if s.f != nil {
+		s.f.Close()
+		os.Remove(s.f.Name())
+	}
+	return nil
+}
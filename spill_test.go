@@ -0,0 +1,154 @@
+package readahead_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/klauspost/readahead"
+)
+
+func TestReaderSpill(t *testing.T) {
+	input := make([]byte, 1<<20)
+	for i := range input {
+		input[i] = byte(i * 7 / 3)
+	}
+	var read int64
+	src := bytes.NewReader(input)
+	rd := dummyReader{readFN: func(dst []byte) (int, error) {
+		n, err := src.Read(dst)
+		atomic.AddInt64(&read, int64(n))
+		return n, err
+	}}
+	dir := t.TempDir()
+	ar, err := readahead.NewReaderSize(rd, 4, 1000, readahead.WithSpill(dir, 2, 50))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	// Read a little to start, then let the input be read ahead.
+	if _, err := ar.Read(make([]byte, 10)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	waitFor(t, "the input to be read ahead", func() bool { return atomic.LoadInt64(&read) >= 50000 })
+	// Memory buffers hold 2000 bytes, the rest must be in the file.
+	if n := atomic.LoadInt64(&read); n < 50000 || n > 55000 {
+		t.Fatalf("want about 50000 bytes read ahead, got %d", n)
+	}
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(got, input[10:]) {
+		t.Fatal("output mismatch")
+	}
+	if err := ar.Close(); err != nil {
+		t.Fatal("error when closing:", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("spill file was not removed: %v", files)
+	}
+
+	// Close before reading everything.
+	src = bytes.NewReader(input)
+	ar, err = readahead.NewReaderSize(src, 4, 1000, readahead.WithSpill(dir, 2, 10))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if _, err := ar.Read(make([]byte, 10)); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if err := ar.Close(); err != nil {
+		t.Fatal("error when closing:", err)
+	}
+	waitFor(t, "the spill file to be removed", func() bool {
+		files, _ := os.ReadDir(dir)
+		return len(files) == 0
+	})
+
+	if _, err := readahead.NewReaderSize(src, 4, 1000, readahead.WithSpill(dir, 0, 10)); err == nil {
+		t.Fatal("expected error when creating, but got nil")
+	}
+}
+
+func TestReaderSpillPassThrough(t *testing.T) {
+	input := make([]byte, 1000)
+	for i := range input {
+		input[i] = byte(i * 7 / 3)
+	}
+	bufs := [][]byte{make([]byte, 100), make([]byte, 100), make([]byte, 100)}
+	src := bytes.NewReader(input)
+	// Allow one read of the input at a time, so the memory buffers never fill up.
+	tokens := make(chan struct{}, 1)
+	rd := dummyReader{readFN: func(dst []byte) (int, error) {
+		<-tokens
+		if len(dst) > 0 {
+			direct := false
+			for _, buf := range bufs {
+				direct = direct || &dst[0] == &buf[0]
+			}
+			if !direct {
+				t.Error("input was not read into a memory buffer")
+			}
+		}
+		return src.Read(dst)
+	}}
+	ar, err := readahead.NewReaderBuffer(rd, bufs, readahead.WithSpill(t.TempDir(), 3, 10))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	got := make([]byte, len(input))
+	for i := 0; i < len(input); i += 100 {
+		tokens <- struct{}{}
+		if _, err := io.ReadFull(ar, got[i:i+100]); err != nil {
+			t.Fatal("error when reading:", err)
+		}
+	}
+	close(tokens)
+	if rest, err := ioutil.ReadAll(ar); err != nil || len(rest) != 0 {
+		t.Fatalf("want no more data, got %d bytes, %v", len(rest), err)
+	}
+	if !bytes.Equal(got, input) {
+		t.Fatal("output mismatch")
+	}
+}
+
+func TestReaderSpillDetach(t *testing.T) {
+	input := make([]byte, 1000)
+	for i := range input {
+		input[i] = byte(i * 7 / 3)
+	}
+	dir := t.TempDir()
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 2, 10, readahead.WithSpill(dir, 2, 10))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	got := make([]byte, 10)
+	if _, err := io.ReadFull(ar, got); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if _, _, err := ar.(readahead.Reader).Detach(); err == nil {
+		t.Fatal("expected error when detaching, but got nil")
+	}
+	// The reader can still be used.
+	rest, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if !bytes.Equal(append(got, rest...), input) {
+		t.Fatal("output mismatch")
+	}
+	if err := ar.Close(); err != nil {
+		t.Fatal("error when closing:", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("spill file was not removed: %v", files)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package readahead
+
+import (
+	"math/bits"
+	"time"
+)
+
+// Stats contains statistics about a reader.
+type Stats struct {
+	// FirstByteLatency is the time from the reader was created
+	// until the first buffer was read from the input.
+	// It is 0 until the first buffer has been read.
+	FirstByteLatency time.Duration
+
+	// Retries is the number of reads from the input that were retried.
+	Retries int64
+
+	// ConsumerReadSizes is a histogram of the size of the buffers
+	// supplied to Read, if enabled with WithConsumerReadHistogram.
+	// Sizes are bucketed by powers of two: Index 0 counts empty buffers,
+	// index 1 counts 1 byte, index 2 counts 2-3 bytes, index 3 counts 4-7 bytes, etc.
+	ConsumerReadSizes [64]int64
+
+	// ConsumerReadBytes is a histogram of the number of bytes returned by Read,
+	// using the same buckets as ConsumerReadSizes.
+	ConsumerReadBytes [64]int64
+
+	// ReadTime is the time the async reader has spent reading from the input,
+	// if enabled with WithReadTiming.
+	// If it is high compared to WaitTime the input is the bottleneck.
+	ReadTime time.Duration
+
+	// WaitTime is the time the async reader has spent waiting for
+	// a buffer to read into, if enabled with WithReadTiming.
+	// If it is high compared to ReadTime the consumer is the bottleneck.
+	WaitTime time.Duration
+
+	// Seeks is the number of calls to Seek.
+	Seeks int64
+
+	// BufferedSeeks is the number of seeks that were satisfied without
+	// seeking the input and discarding the data read ahead,
+	// such as position queries.
+	BufferedSeeks int64
+
+	// SeekBytesDiscarded is the number of bytes read ahead
+	// that were discarded because of seeks.
+	SeekBytesDiscarded int64
+
+	// ModeSwitches is the number of times the access mode
+	// has been changed with SetAccessMode.
+	ModeSwitches int64
+}
+
+// Stats returns statistics about the reader.
+// Stats can be called concurrently with other methods.
+func (a *reader) Stats() Stats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.stats
+}
+
+// recordRead adds a consumer read to the histograms.
+func (a *reader) recordRead(size, n int) {
+	a.mu.Lock()
+	a.stats.ConsumerReadSizes[histBucket(size)]++
+	a.stats.ConsumerReadBytes[histBucket(n)]++
+	a.mu.Unlock()
+}
+
+// histBucket returns the histogram bucket of n.
+func histBucket(n int) int {
+	b := bits.Len(uint(n))
+	if b > 63 {
+		b = 63
+	}
+	return b
+}
@@ -0,0 +1,251 @@
+package readahead_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/readahead"
+)
+
+func TestStatsFirstByteLatency(t *testing.T) {
+	src := bytes.NewBufferString("Testbuffer")
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		time.Sleep(20 * time.Millisecond)
+		return src.Read(dst)
+	}}
+	ar, err := readahead.NewReaderSize(r, 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	_, err = ar.Read(make([]byte, 10))
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	first := ar.(readahead.Reader).Stats().FirstByteLatency
+	if first < 20*time.Millisecond {
+		t.Fatal("expected latency of at least 20ms, got", first)
+	}
+	ioutil.ReadAll(ar)
+	if got := ar.(readahead.Reader).Stats().FirstByteLatency; got != first {
+		t.Fatalf("latency changed from %v to %v", first, got)
+	}
+	ar.Close()
+}
+
+func TestStatsUnexpectedEOFRetries(t *testing.T) {
+	// flaky returns io.ErrUnexpectedEOF fails times before every successful read.
+	flaky := func(fails int) io.Reader {
+		src := strings.NewReader(strings.Repeat("Testbuffer", 10))
+		var failed int
+		return dummyReader{readFN: func(dst []byte) (int, error) {
+			if failed < fails {
+				failed++
+				return 0, io.ErrUnexpectedEOF
+			}
+			failed = 0
+			if len(dst) > 7 {
+				dst = dst[:7]
+			}
+			return src.Read(dst)
+		}}
+	}
+	ar, err := readahead.NewReaderSize(flaky(2), 4, 20, readahead.WithUnexpectedEOFRetries(2, time.Microsecond))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	b, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if string(b) != strings.Repeat("Testbuffer", 10) {
+		t.Fatal("output mismatch")
+	}
+	if got := ar.(readahead.Reader).Stats().Retries; got < 30 {
+		t.Fatal("expected at least 30 retries, got", got)
+	}
+	ar.Close()
+
+	// Too many failures
+	ar, err = readahead.NewReaderSize(flaky(3), 4, 20, readahead.WithUnexpectedEOFRetries(2, time.Microsecond))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	_, err = ioutil.ReadAll(ar)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+	ar.Close()
+}
+
+func TestStatsUnexpectedEOFRetriesClose(t *testing.T) {
+	reading := make(chan struct{}, 1)
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		select {
+		case reading <- struct{}{}:
+		default:
+		}
+		return 0, io.ErrUnexpectedEOF
+	}}
+	ar, err := readahead.NewReaderSize(r, 4, 20, readahead.WithUnexpectedEOFRetries(1, time.Hour))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	<-reading
+	// Close must not wait for the backoff.
+	closed := make(chan error, 1)
+	go func() { closed <- ar.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal("error when closing:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+}
+
+func TestStatsConsumerReadHistogram(t *testing.T) {
+	ar, err := readahead.NewReaderSize(strings.NewReader("0123456789"), 4, 100, readahead.WithConsumerReadHistogram())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := ar.Read(make([]byte, 1)); err != nil {
+			t.Fatal("error when reading:", err)
+		}
+	}
+	// 7 bytes remain.
+	if n, _ := ar.Read(make([]byte, 100)); n != 7 {
+		t.Fatalf("want 7 bytes, got %d", n)
+	}
+	st := ar.(readahead.Reader).Stats()
+	var wantSizes, wantBytes [64]int64
+	wantSizes[1] = 3 // 1 byte
+	wantSizes[7] = 1 // 64-127 bytes
+	wantBytes[1] = 3 // 1 byte
+	wantBytes[3] = 1 // 4-7 bytes
+	if st.ConsumerReadSizes != wantSizes {
+		t.Errorf("want sizes %v, got %v", wantSizes, st.ConsumerReadSizes)
+	}
+	if st.ConsumerReadBytes != wantBytes {
+		t.Errorf("want bytes %v, got %v", wantBytes, st.ConsumerReadBytes)
+	}
+
+	// Not recorded unless enabled.
+	ar2, err := readahead.NewReaderSize(strings.NewReader("0123456789"), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar2.Close()
+	ar2.Read(make([]byte, 1))
+	if st := ar2.(readahead.Reader).Stats(); st.ConsumerReadSizes != [64]int64{} {
+		t.Errorf("unexpected histogram %v", st.ConsumerReadSizes)
+	}
+}
+
+func TestStatsSeeks(t *testing.T) {
+	data := []byte(strings.Repeat("0123456789", 100))
+	ar, err := readahead.NewReadSeekerSize(bytes.NewReader(data), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	dst := make([]byte, 10)
+	if _, err := io.ReadFull(ar, dst); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	// Position queries keep the data read ahead.
+	for i := 0; i < 2; i++ {
+		pos, err := ar.Seek(0, io.SeekCurrent)
+		if err != nil {
+			t.Fatal("error when seeking:", err)
+		}
+		if pos != 10 {
+			t.Fatal("want position 10, got", pos)
+		}
+	}
+	if _, err := io.ReadFull(ar, dst); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if string(dst) != "0123456789" {
+		t.Fatalf("unexpected data %q", dst)
+	}
+	st := ar.(readahead.Reader).Stats()
+	if st.Seeks != 2 || st.BufferedSeeks != 2 || st.SeekBytesDiscarded != 0 {
+		t.Fatalf("unexpected stats after position queries: %+v", st)
+	}
+
+	// Wait for the first buffer to be read ahead.
+	ar.(readahead.Reader).Peek(80)
+	if _, err := ar.Seek(500, io.SeekStart); err != nil {
+		t.Fatal("error when seeking:", err)
+	}
+	st = ar.(readahead.Reader).Stats()
+	if st.Seeks != 3 || st.BufferedSeeks != 2 {
+		t.Fatalf("unexpected seek counts: %+v", st)
+	}
+	if st.SeekBytesDiscarded < 80 {
+		t.Fatal("expected at least 80 bytes discarded, got", st.SeekBytesDiscarded)
+	}
+	if _, err := io.ReadFull(ar, dst); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	if string(dst) != "0123456789" {
+		t.Fatalf("unexpected data %q", dst)
+	}
+}
+
+func TestStatsReadTiming(t *testing.T) {
+	// Slow input.
+	src := strings.NewReader(strings.Repeat("x", 50))
+	r := dummyReader{readFN: func(dst []byte) (int, error) {
+		time.Sleep(5 * time.Millisecond)
+		return src.Read(dst)
+	}}
+	ar, err := readahead.NewReaderSize(r, 2, 10, readahead.WithReadTiming())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	if _, err := ioutil.ReadAll(ar); err != nil {
+		t.Fatal("error when reading:", err)
+	}
+	st := ar.(readahead.Reader).Stats()
+	if st.ReadTime < 25*time.Millisecond {
+		t.Error("expected read time of at least 25ms, got", st.ReadTime)
+	}
+	ar.Close()
+
+	// Slow consumer.
+	ar, err = readahead.NewReaderSize(strings.NewReader(strings.Repeat("x", 50)), 2, 10, readahead.WithReadTiming())
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	for {
+		time.Sleep(5 * time.Millisecond)
+		if _, err := ar.Read(make([]byte, 10)); err != nil {
+			break
+		}
+	}
+	st = ar.(readahead.Reader).Stats()
+	if st.WaitTime < 10*time.Millisecond {
+		t.Error("expected wait time of at least 10ms, got", st.WaitTime)
+	}
+	ar.Close()
+
+	// Not recorded unless enabled.
+	ar, err = readahead.NewReaderSize(r, 2, 10)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	ioutil.ReadAll(ar)
+	if st := ar.(readahead.Reader).Stats(); st.ReadTime != 0 || st.WaitTime != 0 {
+		t.Errorf("unexpected timing %v, %v", st.ReadTime, st.WaitTime)
+	}
+	ar.Close()
+}
@@ -0,0 +1,17 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+//go:build !plan9
+// +build !plan9
+
+package readahead
+
+import (
+	"errors"
+	"syscall"
+)
+
+// wouldBlock returns whether err is returned by a non-blocking writer
+// that cannot accept more data right now.
+func wouldBlock(err error) bool {
+	return errors.Is(err, syscall.EAGAIN)
+}
@@ -0,0 +1,10 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package readahead
+
+// wouldBlock returns whether err is returned by a non-blocking writer
+// that cannot accept more data right now.
+// Plan 9 has no EAGAIN, so this is never the case.
+func wouldBlock(err error) bool {
+	return false
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+//go:build !plan9
+// +build !plan9
+
+package readahead_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/klauspost/readahead"
+)
+
+func TestWriteToWouldBlock(t *testing.T) {
+	input := make([]byte, 1050)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	eagain := &os.PathError{Op: "write", Path: "pipe", Err: syscall.EAGAIN}
+
+	// Retried after a backoff by default.
+	ar, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 100)
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	dst := &flakyWriter{err: eagain}
+	if _, err := ar.(io.WriterTo).WriteTo(dst); err != nil {
+		t.Fatal("error when writing:", err)
+	}
+	if !bytes.Equal(dst.Bytes(), input) {
+		t.Fatal("output mismatch")
+	}
+	ar.Close()
+
+	// Wait for the ready signal.
+	ready := make(chan struct{}, 100)
+	ar, err = readahead.NewReaderSize(bytes.NewReader(input), 4, 100, readahead.WithWriteReady(ready))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	for i := 0; i < cap(ready); i++ {
+		ready <- struct{}{}
+	}
+	dst = &flakyWriter{err: eagain}
+	if _, err := ar.(io.WriterTo).WriteTo(dst); err != nil {
+		t.Fatal("error when writing:", err)
+	}
+	if !bytes.Equal(dst.Bytes(), input) {
+		t.Fatal("output mismatch")
+	}
+	// One signal is used for each write that would block.
+	if waits := cap(ready) - len(ready); waits != dst.writes/2 {
+		t.Fatalf("want %d waits, got %d", dst.writes/2, waits)
+	}
+	ar.Close()
+
+	// A closed ready channel returns the error.
+	closed := make(chan struct{})
+	close(closed)
+	ar, err = readahead.NewReaderSize(bytes.NewReader(input), 4, 100, readahead.WithWriteReady(closed))
+	if err != nil {
+		t.Fatal("error when creating:", err)
+	}
+	defer ar.Close()
+	dst = &flakyWriter{err: eagain}
+	if _, err := ar.(io.WriterTo).WriteTo(dst); err != eagain {
+		t.Fatal("want", eagain, "got", err)
+	}
+
+	if _, err := readahead.NewReaderSize(bytes.NewReader(input), 4, 100, readahead.WithWriteReady(nil)); err == nil {
+		t.Fatal("expected error when creating, but got nil")
+	}
+}